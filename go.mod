@@ -4,14 +4,19 @@ go 1.19
 
 require (
 	github.com/030/logging v0.1.2
+	github.com/ProtonMail/go-crypto v1.0.0
 	github.com/gorilla/mux v1.8.0
 	github.com/hashicorp/go-retryablehttp v0.7.2
+	github.com/klauspost/compress v1.16.7
 	github.com/sirupsen/logrus v1.9.0
+	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.7.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/cloudflare/circl v1.3.3 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
 )
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/morhayn/yaam2/internal/project"
+)
+
+type Permission int
+
+const (
+	Read Permission = iota
+	Publish
+	Admin
+)
+
+const (
+	// Everyone, also not authenticated clients
+	Anonymous = "anonymous"
+	// Any authenticated user
+	AnyUser = "*"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+func (p Permission) String() string {
+	switch p {
+	case Publish:
+		return "publish"
+	case Admin:
+		return "admin"
+	}
+	return "read"
+}
+
+// Check user or user group in acl list
+func inList(user string, list []string) bool {
+	for _, name := range list {
+		switch {
+		case name == Anonymous:
+			return true
+		case name == AnyUser && user != "":
+			return true
+		case user == "":
+			continue
+		case name == user:
+			return true
+		}
+		for _, member := range project.Conf.Auth.Groups[name] {
+			if member == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Admin can publish, publisher can read
+func allowed(user string, acl project.Acl, perm Permission) bool {
+	if inList(user, acl.Admin) {
+		return true
+	}
+	if perm <= Publish && inList(user, acl.Publish) {
+		return true
+	}
+	return perm == Read && inList(user, acl.Read)
+}
+
+// Authorize checks access user to repository or group {pack}/{repo}.
+// Repository without acl use default policy: publish need authenticated user,
+// read need it when requireread set in config file, admin need admin of yaam.
+func Authorize(user, pack, repo string, perm Permission) error {
+	acl := project.Conf.GetRepos(pack)[repo].Acl
+	if g, ok := project.Conf.GetGroups(pack)[repo]; ok {
+		acl = g.Acl
+	}
+	if acl.Empty() {
+		if user == "" && (perm != Read || project.Conf.Auth.RequireRead) {
+			return fmt.Errorf("request is NOT using authentication: %w", ErrUnauthorized)
+		}
+		if perm == Admin {
+			return AuthorizeAdmin(user)
+		}
+		return nil
+	}
+	if allowed(user, acl, perm) {
+		return nil
+	}
+	if user == "" {
+		return fmt.Errorf("anonymous %s '%s/%s' not allowed: %w", perm, pack, repo, ErrUnauthorized)
+	}
+	return fmt.Errorf("user: '%s' %s '%s/%s' not allowed: %w", user, perm, pack, repo, ErrForbidden)
+}
+
+// AuthorizeAdmin checks that user administers yaam: user of config file or
+// user or group in admin list of auth
+func AuthorizeAdmin(user string) error {
+	if user == "" {
+		return fmt.Errorf("anonymous admin not allowed: %w", ErrUnauthorized)
+	}
+	if user == configAdmin || inList(user, project.Conf.Auth.Admin) {
+		return nil
+	}
+	return fmt.Errorf("user: '%s' admin not allowed: %w", user, ErrForbidden)
+}
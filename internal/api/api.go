@@ -1,37 +1,120 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
+
+	"github.com/morhayn/yaam2/internal/project"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func basicAuth(r *http.Request) error {
+const realm = `Basic realm="yaam2"`
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticate returns user from request, empty user for anonymous request
+func Authenticate(r *http.Request) (string, error) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+		for _, t := range tokens {
+			if u, ok := t.User(token); ok {
+				log.Debugf("user: '%s', bearerTokenUsed?: 'true'", u)
+				return u, nil
+			}
+		}
+		return "", fmt.Errorf("bearer token is invalid: %w", ErrUnauthorized)
+	}
 	u, p, ok := r.BasicAuth()
 	log.Debugf("user: '%s', pass: '********', basicAuthUsed?: '%t'", u, ok)
-	if ok {
-		if !(u == os.Getenv("YAAM_USER") && p == os.Getenv("YAAM_PASS")) {
-			// return fmt.Errorf("auth failed")
-			return nil //off Auth
+	if !ok {
+		return "", nil
+	}
+	for _, s := range users {
+		if s.Authenticate(u, p) {
+			return u, nil
 		}
-	} else {
-		// return fmt.Errorf("request is NOT using basic authentication")
-		return nil
+	}
+	return "", fmt.Errorf("user: '%s' auth failed: %w", u, ErrUnauthorized)
+}
+
+func Validation(method string, r *http.Request, w http.ResponseWriter) (string, error) {
+	if !(method == "PUT" || method == "POST" || method == "GET" || method == "HEAD" || method == "DELETE") {
+		return "", fmt.Errorf("only PUTs, POSTs, GETs, HEADs and DELETEs are supported. Used method: '%s'", method)
+	}
+
+	u, err := Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", realm)
+		return "", fmt.Errorf("basic auth failed. Error: '%w'", err)
 	}
 
+	return u, nil
+}
+
+// Access validate user access to repository, set WWW-Authenticate header for
+// anonymous user
+func Access(user, pack, repo string, perm Permission, w http.ResponseWriter) error {
+	if err := Authorize(user, pack, repo, perm); err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			w.Header().Set("WWW-Authenticate", realm)
+		}
+		return err
+	}
 	return nil
 }
 
-func Validation(method string, r *http.Request, w http.ResponseWriter) error {
-	if !(method == "PUT" || method == "POST" || method == "GET" || method == "HEAD") {
-		return fmt.Errorf("only PUTs, POSTs, GETs and HEADs are supported. Used method: '%s'", method)
+// AccessAdmin validate that user administers yaam, set WWW-Authenticate
+// header for anonymous user
+func AccessAdmin(user string, w http.ResponseWriter) error {
+	if err := AuthorizeAdmin(user); err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			w.Header().Set("WWW-Authenticate", realm)
+		}
+		return err
 	}
+	return nil
+}
 
-	if err := basicAuth(r); err != nil {
-		return fmt.Errorf("basic auth failed. Error: '%v'", err)
+// ReadableMembers returns members of group that user of request can read,
+// group acl does not grant access to its members
+func ReadableMembers(r *http.Request, pack string, members []string) []string {
+	user := ""
+	if r != nil {
+		user, _ = Authenticate(r)
 	}
+	readable := []string{}
+	for _, repo := range members {
+		if err := Authorize(user, pack, repo, Read); err != nil {
+			log.Debugf("member: '%s' of group skipped. Error: '%v'", repo, err)
+			continue
+		}
+		readable = append(readable, repo)
+	}
+	return readable
+}
 
-	return nil
+// BaseUrl returns public scheme and host of yaam: baseurl from config file,
+// X-Forwarded-Proto and X-Forwarded-Host headers of proxy or host of request
+func BaseUrl(r *http.Request) string {
+	if project.Conf.BaseUrl != "" {
+		return strings.TrimSuffix(project.Conf.BaseUrl, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme, _, _ = strings.Cut(proto, ",")
+	}
+	host := r.Host
+	if fh := r.Header.Get("X-Forwarded-Host"); fh != "" {
+		host, _, _ = strings.Cut(fh, ",")
+	}
+	if host == "" {
+		host = project.Conf.HostAndPort()
+	}
+	return strings.TrimSpace(scheme) + "://" + strings.TrimSpace(host)
 }
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/morhayn/yaam2/internal/project"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidation(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := "/tmp/yaam2.htpasswd"
+	if err := os.WriteFile(htpasswd, []byte("# users\nci:"+string(hash)+"\nold:{SHA}xxxx\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(htpasswd)
+	project.Conf = project.ConfigFile{
+		User: "hello",
+		Pass: "world",
+		Auth: project.AuthConf{
+			Htpasswd: htpasswd,
+			Tokens:   []project.Token{{User: "bot", Token: "t0ken"}},
+		},
+	}
+	if err := LoadUsers(project.Conf); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, method, user, pass, bearer string
+		unauthorized                     bool
+	}{
+		{name: "anonymous get", method: "GET"},
+		{name: "anonymous put", method: "PUT", unauthorized: true},
+		{name: "config user put", method: "PUT", user: "hello", pass: "world"},
+		{name: "wrong pass get", method: "GET", user: "hello", pass: "bad", unauthorized: true},
+		{name: "htpasswd user post", method: "POST", user: "ci", pass: "secret"},
+		{name: "htpasswd wrong pass", method: "PUT", user: "ci", pass: "bad", unauthorized: true},
+		{name: "not bcrypt user", method: "PUT", user: "old", pass: "xxxx", unauthorized: true},
+		{name: "bearer token", method: "PUT", bearer: "t0ken"},
+		{name: "bad bearer token", method: "GET", bearer: "bad", unauthorized: true},
+		{name: "token as password", method: "PUT", user: "bot", pass: "t0ken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/maven/test/a.jar", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			user, err := Validation(tt.method, r, w)
+			if err == nil {
+				perm := Read
+				if tt.method == "PUT" || tt.method == "POST" {
+					perm = Publish
+				}
+				err = Access(user, "maven", "test", perm, w)
+			}
+			if errors.Is(err, ErrUnauthorized) != tt.unauthorized {
+				t.Fatalf("unexpected result: '%v'", err)
+			}
+			if tt.unauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("WWW-Authenticate header not set")
+			}
+		})
+	}
+	t.Run("require read", func(t *testing.T) {
+		project.Conf.Auth.RequireRead = true
+		defer func() { project.Conf.Auth.RequireRead = false }()
+		r := httptest.NewRequest("GET", "/maven/test/a.jar", nil)
+		user, err := Validation("GET", r, httptest.NewRecorder())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Authorize(user, "maven", "test", Read); !errors.Is(err, ErrUnauthorized) {
+			t.Fatal("anonymous read allowed")
+		}
+	})
+	t.Run("method not allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPatch, "/maven/test/a.jar", nil)
+		if _, err := Validation(r.Method, r, httptest.NewRecorder()); err == nil || errors.Is(err, ErrUnauthorized) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		Auth: project.AuthConf{
+			Groups: map[string][]string{"developers": {"alice", "bob"}},
+		},
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"releases": {Acl: project.Acl{
+					Read:    []string{Anonymous},
+					Publish: []string{"ci"},
+					Admin:   []string{"admin"},
+				}},
+				"internal": {Acl: project.Acl{
+					Read:    []string{"developers"},
+					Publish: []string{"developers"},
+				}},
+				"private": {Acl: project.Acl{
+					Read: []string{AnyUser},
+				}},
+			},
+		},
+	}
+	tests := []struct {
+		name, user, repo string
+		perm             Permission
+		err              error
+	}{
+		{name: "anonymous read", repo: "releases", perm: Read},
+		{name: "anonymous publish", repo: "releases", perm: Publish, err: ErrUnauthorized},
+		{name: "ci publish", user: "ci", repo: "releases", perm: Publish},
+		{name: "developer publish", user: "alice", repo: "releases", perm: Publish, err: ErrForbidden},
+		{name: "admin publish", user: "admin", repo: "releases", perm: Publish},
+		{name: "ci admin", user: "ci", repo: "releases", perm: Admin, err: ErrForbidden},
+		{name: "group read", user: "bob", repo: "internal", perm: Read},
+		{name: "group publish", user: "alice", repo: "internal", perm: Publish},
+		{name: "not group read", user: "ci", repo: "internal", perm: Read, err: ErrForbidden},
+		{name: "anonymous group read", repo: "internal", perm: Read, err: ErrUnauthorized},
+		{name: "any user read", user: "ci", repo: "private", perm: Read},
+		{name: "any user anonymous read", repo: "private", perm: Read, err: ErrUnauthorized},
+		{name: "no acl anonymous read", repo: "other", perm: Read},
+		{name: "no acl anonymous publish", repo: "other", perm: Publish, err: ErrUnauthorized},
+		{name: "no acl user publish", user: "alice", repo: "other", perm: Publish},
+		{name: "no acl user admin", user: "alice", repo: "other", perm: Admin, err: ErrForbidden},
+		{name: "no acl anonymous admin", repo: "other", perm: Admin, err: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Authorize(tt.user, "maven", tt.repo, tt.perm)
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("expected: '%v', got: '%v'", tt.err, err)
+			}
+		})
+	}
+	t.Run("yaam admin", func(t *testing.T) {
+		project.Conf.Auth.Admin = []string{"developers"}
+		defer func() { project.Conf.Auth.Admin = nil }()
+		if err := AuthorizeAdmin("bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Authorize("bob", "maven", "other", Admin); err != nil {
+			t.Fatal(err)
+		}
+		if err := AuthorizeAdmin("ci"); !errors.Is(err, ErrForbidden) {
+			t.Fatalf("error: '%v' not expected", err)
+		}
+		if err := AuthorizeAdmin(""); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("error: '%v' not expected", err)
+		}
+	})
+}
+
+func TestBaseUrl(t *testing.T) {
+	tests := []struct {
+		name, baseurl, proto, host, expected string
+	}{
+		{name: "request host", expected: "http://yaam.local:25213"},
+		{name: "config baseurl", baseurl: "https://yaam.example.com/", proto: "http", expected: "https://yaam.example.com"},
+		{name: "forwarded proto", proto: "https", expected: "https://yaam.local:25213"},
+		{name: "forwarded host", proto: "https, http", host: "yaam.example.com, proxy", expected: "https://yaam.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project.Conf = project.ConfigFile{Port: "25213", BaseUrl: tt.baseurl}
+			r := httptest.NewRequest("GET", "http://yaam.local:25213/npm/npmjs/react", nil)
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.host != "" {
+				r.Header.Set("X-Forwarded-Host", tt.host)
+			}
+			if u := BaseUrl(r); u != tt.expected {
+				t.Fatalf("base url: '%s' expected: '%s'", u, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/morhayn/yaam2/internal/project"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserStore is the interface that wraps the basic Authenticate method.
+//
+// Authenticate reports whether the user and password are valid.
+type UserStore interface {
+	Authenticate(user, pass string) bool
+}
+
+// TokenStore is the interface that wraps the basic User method.
+//
+// User returns the user that owns a bearer token.
+type TokenStore interface {
+	User(token string) (string, bool)
+}
+
+var (
+	users  []UserStore
+	tokens []TokenStore
+	// User of config file, administers yaam
+	configAdmin string
+)
+
+// User and password from config file (or YAAM_USER and YAAM_PASS)
+type configUser struct {
+	user, pass string
+}
+
+func (c configUser) Authenticate(user, pass string) bool {
+	return equal(c.user, user) && equal(c.pass, pass)
+}
+
+// Users with bcrypt hashes from htpasswd file
+type htpasswdUsers map[string]string
+
+func (h htpasswdUsers) Authenticate(user, pass string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// Static token list from config file
+type staticTokens map[string]string
+
+func (s staticTokens) User(token string) (string, bool) {
+	for t, u := range s {
+		if equal(t, token) {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// Basic auth with token as password
+func (s staticTokens) Authenticate(user, pass string) bool {
+	u, ok := s.User(pass)
+	return ok && u == user
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Read htpasswd file, only bcrypt hashes supported
+func readHtpasswd(f string) (htpasswdUsers, error) {
+	file, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	h := htpasswdUsers{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(hash, "$2") {
+			log.Warnf("htpasswd: user '%s' skipped, only bcrypt hashes are supported", user)
+			continue
+		}
+		h[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// LoadUsers fill user stores from config file
+func LoadUsers(c project.ConfigFile) error {
+	users = nil
+	tokens = nil
+	configAdmin = ""
+	user, pass := c.User, c.Pass
+	if user == "" && pass == "" {
+		user, pass = os.Getenv("YAAM_USER"), os.Getenv("YAAM_PASS")
+	}
+	if user != "" && pass != "" {
+		users = append(users, configUser{user: user, pass: pass})
+		configAdmin = user
+	}
+	if c.Auth.Htpasswd != "" {
+		h, err := readHtpasswd(c.Auth.Htpasswd)
+		if err != nil {
+			return err
+		}
+		users = append(users, h)
+	}
+	if len(c.Auth.Tokens) > 0 {
+		s := staticTokens{}
+		for _, t := range c.Auth.Tokens {
+			s[t.Token] = t.User
+		}
+		users = append(users, s)
+		tokens = append(tokens, s)
+	}
+	log.Debugf("user stores: '%d', token stores: '%d'", len(users), len(tokens))
+	return nil
+}
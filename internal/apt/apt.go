@@ -1,36 +1,54 @@
 package apt
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
 
 	"github.com/morhayn/yaam2/internal/artifact"
 	"github.com/morhayn/yaam2/internal/file"
 	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Apt struct {
 	ResponseWriter http.ResponseWriter
+	Request        *http.Request
 	RequestBody    io.ReadCloser
 	RequestURI     string
 	Repo           string
 	Artifact       string
 }
 
-func (a Apt) downloadAgainIfInvalid(atf artifact.Artefact, resp *http.Response) error {
+func (a Apt) downloadAgainIfInvalid(atf artifact.Artefact, resp *http.Response, repo artifact.PublicRepository) error {
 	log.Trace(resp.StatusCode)
+	if _, fileExists := file.Exists(atf.Path); !fileExists && resp.StatusCode == http.StatusNotFound {
+		return artifact.RememberNotFound(atf, project.Conf.Caches.Apt[a.Repo].NegativeTTL())
+	}
 	if resp.StatusCode == http.StatusOK {
-		if err := file.CreateIfDoesNotExistInvalidOrEmpty(atf.Url, atf.Path, resp.Body, false); err != nil {
+		verify := func(tmp string) error {
+			return verifyDownload(atf.Path, tmp)
+		}
+		if err := file.CreateIfDoesNotExistInvalidOrEmpty(atf.Url, atf.Path, resp.Body, false, verify); err != nil {
 			return err
 		}
+		if isIndex(atf.Path) {
+			if err := file.WriteState(atf.Path, file.NewState(resp.Header)); err != nil {
+				return err
+			}
+		}
 	}
 
 	if file.EmptyFile(atf.Path) {
-		if err := a.Preserve(); err != nil {
+		if err := a.preserveFile(atf, repo); err != nil {
 			return err
 		}
 	}
@@ -38,12 +56,215 @@ func (a Apt) downloadAgainIfInvalid(atf artifact.Artefact, resp *http.Response)
 	return nil
 }
 
+// Release and its detached signature Release.gpg are one unit: when one of
+// them changed in upstream, other one cached before is removed and downloaded
+// again on next request
+func dropSignedWith(f string) error {
+	var other string
+	switch filepath.Base(f) {
+	case "Release":
+		other = f + ".gpg"
+	case "Release.gpg":
+		other = strings.TrimSuffix(f, ".gpg")
+	default:
+		return nil
+	}
+	if err := storage.Remove(other); err != nil {
+		return err
+	}
+	if err := file.RemoveState(other); err != nil {
+		return err
+	}
+	log.Debugf("file: '%s' removed, signed with: '%s' modified in upstream", other, f)
+	return nil
+}
+
+// Download again release modified in upstream
+func (a Apt) revalidate(atf artifact.Artefact, repo artifact.PublicRepository) error {
+	resp, err := artifact.Revalidate(atf, project.Conf.Caches.Apt[a.Repo].IndexAge(), repo)
+	if err != nil || resp == nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := file.CreateIfDoesNotExistInvalidOrEmpty(atf.Url, atf.Path, resp.Body, true); err != nil {
+		return err
+	}
+	if err := dropSignedWith(atf.Path); err != nil {
+		return err
+	}
+	return file.WriteState(atf.Path, file.NewState(resp.Header))
+}
+
+// Verify downloaded file with SHA256 and size, file is removed if not valid
+func verify(f string, e releaseEntry) error {
+	size, _ := file.Exists(f)
+	sum, err := file.Digest(f, sha256.New())
+	if err != nil {
+		return err
+	}
+	if sum != e.Sha256 || (e.Size > 0 && size != e.Size) {
+		log.Errorf("file: '%s' sha256: '%s' size: '%d' does not match expected sha256: '%s' size: '%d'", f, sum, size, e.Sha256, e.Size)
+		if err := storage.Remove(f); err != nil {
+			return err
+		}
+		if err := file.RemoveState(f); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: '%s'", file.CheckSumNotValid, f)
+	}
+	return nil
+}
+
+// Index file must match SHA256 in Release served to client. Index is
+// downloaded again (by-hash if upstream supports it) when checksum changed.
+func (a Apt) preserveIndex(atf artifact.Artefact, repo artifact.PublicRepository) error {
+	rf, rel, ok := releaseFor(atf.Path)
+	if !ok {
+		return a.preserveFile(atf, repo)
+	}
+	r, err := parseRelease(rf)
+	if err != nil {
+		return err
+	}
+	e, ok := r.Files[rel]
+	if !ok {
+		log.Debugf("index: '%s' not found in release: '%s'", rel, rf)
+		return a.preserveFile(atf, repo)
+	}
+	if _, fileExists := file.Exists(atf.Path); fileExists {
+		s := file.ReadState(atf.Path)
+		if s.Digest == e.Sha256 {
+			return nil
+		}
+		// Cached before digest was kept in state
+		if sum, err := file.Digest(atf.Path, sha256.New()); err == nil && sum == e.Sha256 {
+			s.Digest = sum
+			return file.WriteState(atf.Path, s)
+		}
+	}
+	url := atf.Url
+	if r.ByHash {
+		url = strings.TrimSuffix(atf.Url, path.Base(atf.Url)) + "by-hash/SHA256/" + e.Sha256
+	}
+	resp, err := repo.Download(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: '%s' not completed statusCode: '%d'", url, resp.StatusCode)
+	}
+	verifyIndex := func(tmp string) error {
+		return verify(tmp, e)
+	}
+	if err := file.CreateIfDoesNotExistInvalidOrEmpty(url, atf.Path, resp.Body, true, verifyIndex); err != nil {
+		// Cached index does not match release too
+		if errors.Is(err, file.CheckSumNotValid) {
+			if rerr := storage.Remove(atf.Path); rerr != nil {
+				return rerr
+			}
+			if rerr := file.RemoveState(atf.Path); rerr != nil {
+				return rerr
+			}
+		}
+		return err
+	}
+	s := file.NewState(resp.Header)
+	s.Digest = e.Sha256
+	return file.WriteState(atf.Path, s)
+}
+
+// Download file if not cached, release and unknown index files are revalidated
+func (a Apt) preserveFile(atf artifact.Artefact, repo artifact.PublicRepository) error {
+	if size, fileExists := file.Exists(atf.Path); fileExists && size > 0 {
+		if isIndex(atf.Path) {
+			return a.revalidate(atf, repo)
+		}
+		return nil
+	}
+	if isPool(atf.Path) && artifact.Streamable(a.ResponseWriter, a.Request) {
+		return a.stream(atf, repo)
+	}
+	resp, err := repo.Download(atf.Url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	return a.downloadAgainIfInvalid(atf, resp, repo)
+}
+
+// Verify file tmp downloaded for f: by-hash file must match hash in path,
+// package must match Packages index
+func verifyDownload(f, tmp string) error {
+	if sum := byHashSha256(f); sum != "" {
+		return verify(tmp, releaseEntry{Sha256: sum})
+	}
+	if isPool(f) {
+		return verifyPackage(f, tmp)
+	}
+	return nil
+}
+
+// Package must match checksum in cached Packages index, f is downloaded
+// file of package pool
+func verifyPackage(pool, f string) error {
+	e, ok, err := poolEntry(pool)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Debugf("package: '%s' not found in cached Packages indexes, checksum not verified", pool)
+		return nil
+	}
+	return verify(f, e)
+}
+
+// Send package to client while it is downloaded, package is cached only if
+// it matches Packages index
+func (a Apt) stream(atf artifact.Artefact, repo artifact.PublicRepository) error {
+	resp, err := repo.Download(atf.Url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return artifact.RememberNotFound(atf, project.Conf.Caches.Apt[a.Repo].NegativeTTL())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: '%s' not completed statusCode: '%d'", atf.Url, resp.StatusCode)
+	}
+	return artifact.Stream(a.ResponseWriter, resp, atf.Path, func(tmp string) error {
+		return verifyPackage(atf.Path, tmp)
+	})
+}
+
 func (a Apt) Preserve(urlStrings ...string) error {
 	urlString := a.RequestURI
 	if len(urlStrings) > 0 {
 		urlString = urlStrings[0]
 	}
 	log.Tracef("urlString: '%s'", urlString)
+	// Hosted repository has no upstream, packages and indexes are on disk
+	if project.Conf.IsHosted("apt", a.Repo) {
+		return nil
+	}
 
 	repoInConfigFile, err := artifact.RepoInConfigFile(urlString, a.Repo, project.Conf.Caches.Apt)
 	if err != nil {
@@ -55,25 +276,30 @@ func (a Apt) Preserve(urlStrings ...string) error {
 		if err != nil {
 			return err
 		}
-
-		resp, err := file.DownloadWithRetries(atf.Url, repoInConfigFile.User, repoInConfigFile.Pass)
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				panic(err)
+		// Pool and by-hash files are cached forever, release is revalidated
+		// after index max age, other index files follow checksums in release. One
+		// fetch of file at a time, concurrent requests wait for it.
+		return artifact.Fetch(atf.Path, func() error {
+			if isIndex(atf.Path) && !isRelease(atf.Path) {
+				return a.preserveIndex(atf, repoInConfigFile)
 			}
-		}()
-
-		if err := a.downloadAgainIfInvalid(atf, resp); err != nil {
-			return err
-		}
+			return a.preserveFile(atf, repoInConfigFile)
+		})
 	}
 
 	return nil
 }
+
+// Publish store uploaded file. Hosted repository accepts packages uploaded to
+// {distribution}/{component}/{name}.deb and regenerates indexes.
 func (a Apt) Publish() error {
+	if project.Conf.IsHosted("apt", a.Repo) {
+		if err := publish(a.Repo, a.Artifact, a.RequestBody); err != nil {
+			return err
+		}
+		a.ResponseWriter.WriteHeader(http.StatusCreated)
+		return nil
+	}
 	if err := artifact.StoreOnDisk(a.RequestURI, a.RequestBody); err != nil {
 		return err
 	}
@@ -82,7 +308,7 @@ func (a Apt) Publish() error {
 }
 
 func (a Apt) Read() error {
-	if err := artifact.ReadFromDisk(a.ResponseWriter, a.RequestURI); err != nil {
+	if err := artifact.ReadFromDisk(a.ResponseWriter, a.Request, a.RequestURI); err != nil {
 		return fmt.Errorf(file.CannotReadErrMsg, err)
 	}
 
@@ -0,0 +1,508 @@
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/klauspost/compress/zstd"
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+	"github.com/ulikunitz/xz"
+)
+
+func TestPreserveIndex(t *testing.T) {
+	packages := "Package: test\nVersion: 1.0\n"
+	release := func(packages string, byHash bool) string {
+		r := "Suite: stable\n"
+		if byHash {
+			r += "Acquire-By-Hash: yes\n"
+		}
+		return r + fmt.Sprintf("SHA256:\n %x %d main/binary-amd64/Packages\n", sha256.Sum256([]byte(packages)), len(packages))
+	}
+	files := map[string]string{}
+	hits := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		hits[r.URL.Path]++
+		w.Write([]byte(f))
+	}))
+	defer upstream.Close()
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Apt: map[string]project.Repos{
+				"debian": {Url: upstream.URL, IndexMaxAge: time.Nanosecond},
+			},
+		},
+	}
+	backend := t.TempDir()
+	storage.Backend = storage.Local{Dir: backend}
+	defer func() { storage.Backend = nil }()
+	h, _ := project.RepositoriesHome()
+	get := func(t *testing.T, artifact string) error {
+		a := Apt{ResponseWriter: httptest.NewRecorder(), RequestURI: "/apt/debian/" + artifact, Repo: "debian", Artifact: artifact}
+		return a.Preserve()
+	}
+	cached := func(artifact string) string {
+		b, _ := os.ReadFile(filepath.Join(h, "apt/debian", artifact))
+		return string(b)
+	}
+	index := "dists/stable/main/binary-amd64/Packages"
+
+	files["/dists/stable/Release"] = release(packages, false)
+	files["/"+index] = packages
+	t.Run("download", func(t *testing.T) {
+		if err := get(t, "dists/stable/Release"); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(t, index); err != nil {
+			t.Fatal(err)
+		}
+		if cached(index) != packages {
+			t.Fatal("wrong index ", cached(index))
+		}
+	})
+	t.Run("index matches release", func(t *testing.T) {
+		if err := get(t, index); err != nil {
+			t.Fatal(err)
+		}
+		if hits["/"+index] != 1 {
+			t.Fatalf("index downloaded again, hits: '%d'", hits["/"+index])
+		}
+	})
+	packages = "Package: test\nVersion: 1.1\n"
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(packages)))
+	files["/dists/stable/Release"] = release(packages, true)
+	files["/dists/stable/main/binary-amd64/by-hash/SHA256/"+sum] = packages
+	t.Run("release revalidated and index by-hash", func(t *testing.T) {
+		if err := get(t, "dists/stable/Release"); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(t, index); err != nil {
+			t.Fatal(err)
+		}
+		if cached(index) != packages || hits["/"+index] != 1 {
+			t.Fatalf("index: '%s', hits: '%d'", cached(index), hits["/"+index])
+		}
+	})
+	t.Run("index does not match release", func(t *testing.T) {
+		files["/dists/stable/Release"] = release("other", false)
+		if err := get(t, "dists/stable/Release"); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(t, index); !errors.Is(err, file.CheckSumNotValid) {
+			t.Fatal("checksum not verified ", err)
+		}
+		if _, fileExists := file.Exists(filepath.Join(h, "apt/debian", index)); fileExists {
+			t.Fatal("invalid index not removed")
+		}
+		if _, fileExists := file.Exists(filepath.Join(backend, "apt/debian", index)); fileExists {
+			t.Fatal("invalid index not removed from storage")
+		}
+	})
+	t.Run("release.gpg with release", func(t *testing.T) {
+		files["/dists/stable/Release.gpg"] = "signature"
+		if err := get(t, "dists/stable/Release.gpg"); err != nil {
+			t.Fatal(err)
+		}
+		files["/dists/stable/Release"] = release("newer", false)
+		files["/dists/stable/Release.gpg"] = "newer signature"
+		if err := get(t, "dists/stable/Release"); err != nil {
+			t.Fatal(err)
+		}
+		if _, fileExists := file.Exists(filepath.Join(h, "apt/debian/dists/stable/Release.gpg")); fileExists {
+			t.Fatal("signature of old release kept")
+		}
+		if err := get(t, "dists/stable/Release.gpg"); err != nil {
+			t.Fatal(err)
+		}
+		if cached("dists/stable/Release.gpg") != "newer signature" {
+			t.Fatal("wrong signature ", cached("dists/stable/Release.gpg"))
+		}
+	})
+	t.Run("by-hash", func(t *testing.T) {
+		bad := "dists/stable/main/binary-amd64/by-hash/SHA256/" + fmt.Sprintf("%x", sha256.Sum256([]byte("bad")))
+		files["/"+bad] = "not bad"
+		if err := get(t, bad); !errors.Is(err, file.CheckSumNotValid) {
+			t.Fatal("by-hash checksum not verified ", err)
+		}
+	})
+}
+
+// Packages index compressed by extension: .gz or .xz
+func compressedIndex(t *testing.T, packages, ext string) []byte {
+	var b bytes.Buffer
+	var zw io.WriteCloser
+	var err error
+	switch ext {
+	case ".gz":
+		zw = gzip.NewWriter(&b)
+	case ".xz":
+		zw, err = xz.NewWriter(&b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write([]byte(packages)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestVerifyPackage(t *testing.T) {
+	deb := "deb content"
+	packages := fmt.Sprintf("Package: good\nFilename: pool/main/g/good/good_1.0_amd64.deb\nSize: %d\nSHA256: %x\n\n", len(deb), sha256.Sum256([]byte(deb)))
+	packages += fmt.Sprintf("Package: bad\nFilename: pool/main/b/bad/bad_1.0_amd64.deb\nSize: %d\nSHA256: %x\n", len(deb), sha256.Sum256([]byte(deb)))
+	// Debian and Ubuntu mirrors may publish only Packages.xz
+	for _, ext := range []string{".gz", ".xz"} {
+		t.Run("Packages"+ext, func(t *testing.T) {
+			index := compressedIndex(t, packages, ext)
+			files := map[string]string{
+				"/dists/stable/Release":                          fmt.Sprintf("SHA256:\n %x %d main/binary-amd64/Packages%s\n", sha256.Sum256(index), len(index), ext),
+				"/dists/stable/main/binary-amd64/Packages" + ext: string(index),
+				"/pool/main/g/good/good_1.0_amd64.deb":           deb,
+				"/pool/main/b/bad/bad_1.0_amd64.deb":             "truncated",
+				"/pool/main/o/other/other_1.0_amd64.deb":         deb,
+			}
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, ok := files[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(f))
+			}))
+			defer upstream.Close()
+			project.Conf = project.ConfigFile{
+				CacheDir: t.TempDir(),
+				Caches: project.Rep{
+					Apt: map[string]project.Repos{
+						"debian": {Url: upstream.URL},
+					},
+				},
+			}
+			h, _ := project.RepositoriesHome()
+			get := func(artifact string) error {
+				a := Apt{ResponseWriter: httptest.NewRecorder(), RequestURI: "/apt/debian/" + artifact, Repo: "debian", Artifact: artifact}
+				return a.Preserve()
+			}
+			for _, f := range []string{"dists/stable/Release", "dists/stable/main/binary-amd64/Packages" + ext} {
+				if err := get(f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range []struct {
+				name string
+				err  error
+			}{
+				{name: "good"},
+				{name: "bad", err: file.CheckSumNotValid},
+				{name: "other"},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					artifact := fmt.Sprintf("pool/main/%s/%s/%s_1.0_amd64.deb", tt.name[:1], tt.name, tt.name)
+					err := get(artifact)
+					if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+						t.Fatalf("expected: '%v', got: '%v'", tt.err, err)
+					}
+					_, fileExists := file.Exists(filepath.Join(h, "apt/debian", artifact))
+					if fileExists != (tt.err == nil) {
+						t.Fatalf("file exists: '%t'", fileExists)
+					}
+				})
+			}
+		})
+	}
+}
+
+// Deb archive with control.tar.gz
+func testDeb(t *testing.T, control string) []byte {
+	return compressedDeb(t, control, ".gz")
+}
+
+// Deb archive with control tar compressed by extension: "", .gz, .xz or .zst
+func compressedDeb(t *testing.T, control, ext string) []byte {
+	var ctl bytes.Buffer
+	var zw io.WriteCloser
+	var err error
+	switch ext {
+	case ".gz":
+		zw = gzip.NewWriter(&ctl)
+	case ".xz":
+		zw, err = xz.NewWriter(&ctl)
+	case ".zst":
+		zw, err = zstd.NewWriter(&ctl)
+	default:
+		zw = nopWriteCloser{&ctl}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: "./control", Mode: 0o644, Size: int64(len(control))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(control)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var deb bytes.Buffer
+	deb.WriteString("!<arch>\n")
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar" + ext, ctl.Bytes()},
+		{"data.tar.gz", []byte("data")},
+	} {
+		fmt.Fprintf(&deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name, 0, 0, 0, "100644", len(m.data))
+		deb.Write(m.data)
+		if len(m.data)%2 == 1 {
+			deb.WriteString("\n")
+		}
+	}
+	return deb.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestPoolEntry(t *testing.T) {
+	root := t.TempDir()
+	index := func(suite, sum string) string {
+		f := filepath.Join(root, "dists", suite, "main/binary-amd64/Packages")
+		if err := os.MkdirAll(filepath.Dir(f), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte("Package: hello\nFilename: pool/main/h/hello/hello_1.0_amd64.deb\nSize: 4\nSHA256: "+sum+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.WriteState(f, file.State{Digest: sum}); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	stable, next := index("stable", "aa"), index("testing", "aa")
+	pool := filepath.Join(root, "pool/main/h/hello/hello_1.0_amd64.deb")
+	t.Run("first index", func(t *testing.T) {
+		e, ok, err := poolEntry(pool)
+		if err != nil || !ok || e.Sha256 != "aa" || e.Size != 4 {
+			t.Fatal("wrong entry ", e, ok, err)
+		}
+		if _, ok := lookups[stable]; !ok {
+			t.Fatal("index not cached")
+		}
+		if _, ok := lookups[next]; ok {
+			t.Fatal("walk not stopped at first match")
+		}
+	})
+	t.Run("index changed", func(t *testing.T) {
+		index("stable", "bb")
+		if e, ok, err := poolEntry(pool); err != nil || !ok || e.Sha256 != "bb" {
+			t.Fatal("cached entry of old index ", e, ok, err)
+		}
+	})
+	t.Run("index removed", func(t *testing.T) {
+		if err := os.Remove(stable); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok, err := poolEntry(pool); err != nil || !ok || e.Sha256 != "aa" {
+			t.Fatal("entry of other index not found ", e, ok, err)
+		}
+		if _, ok := lookups[stable]; ok {
+			t.Fatal("lookup of removed index kept")
+		}
+	})
+}
+
+func TestDebControl(t *testing.T) {
+	for _, ext := range []string{"", ".gz", ".xz", ".zst"} {
+		t.Run("control.tar"+ext, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "daemon_1.0_amd64.deb")
+			if err := os.WriteFile(f, compressedDeb(t, "Package: daemon\nVersion: 1.0\nArchitecture: amd64\n", ext), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := debControl(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Package != "daemon" || c.Version != "1.0" || c.Architecture != "amd64" {
+				t.Fatal("wrong control ", c)
+			}
+		})
+	}
+}
+
+func TestPublishHosted(t *testing.T) {
+	key, err := openpgp.NewEntity("yaam2", "", "yaam2@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.AddSigningSubkey(nil); err != nil {
+		t.Fatal(err)
+	}
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.SerializePrivate(aw, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.asc")
+	if err := os.WriteFile(keyFile, armored.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Apt: map[string]project.Repos{
+				"internal": {Hosted: true, Architectures: []string{"amd64", "arm64"}, SigningKey: keyFile},
+			},
+		},
+	}
+	h, _ := project.RepositoriesHome()
+	repoDir := filepath.Join(h, "apt/internal")
+	upload := func(artifact string, deb []byte) error {
+		a := Apt{ResponseWriter: httptest.NewRecorder(), RequestURI: "/apt/internal/" + artifact, Repo: "internal", Artifact: artifact, RequestBody: io.NopCloser(bytes.NewReader(deb))}
+		return a.Publish()
+	}
+	daemon := testDeb(t, "Package: daemon\nVersion: 1:1.0\nArchitecture: amd64\nDescription: test\n multi line\n")
+	for _, deb := range [][]byte{daemon, testDeb(t, "Package: libconf\nVersion: 2.0\nArchitecture: all\n")} {
+		if err := upload("stable/main/upload.deb", deb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("packages", func(t *testing.T) {
+		filename := "pool/stable/main/d/daemon/daemon_1.0_amd64.deb"
+		e, ok, err := packagesEntry(filepath.Join(repoDir, "dists/stable/main/binary-amd64/Packages.gz"), filename)
+		if err != nil || !ok {
+			t.Fatal("package not found in index ", err)
+		}
+		if e.Sha256 != fmt.Sprintf("%x", sha256.Sum256(daemon)) || e.Size != int64(len(daemon)) {
+			t.Fatal("wrong package in index ", e)
+		}
+		if fi, err := os.Stat(filepath.Join(repoDir, filename)); err != nil || fi.Mode().Perm() != 0o644 {
+			t.Fatal("wrong mode of package ", fi.Mode(), err)
+		}
+		b, _ := os.ReadFile(filepath.Join(repoDir, "dists/stable/main/binary-arm64/Packages"))
+		if strings.Contains(string(b), "daemon") || !strings.Contains(string(b), "Filename: pool/stable/main/libc/libconf/libconf_2.0_all.deb") {
+			t.Fatal("wrong arm64 index ", string(b))
+		}
+	})
+	t.Run("release", func(t *testing.T) {
+		r, err := parseRelease(filepath.Join(repoDir, "dists/stable/InRelease"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packages := filepath.Join(repoDir, "dists/stable/main/binary-amd64/Packages")
+		sum, _ := file.Digest(packages, sha256.New())
+		if r.Files["main/binary-amd64/Packages"].Sha256 != sum {
+			t.Fatal("wrong release ", r.Files)
+		}
+		b, _ := os.ReadFile(filepath.Join(repoDir, "dists/stable/InRelease"))
+		block, _ := clearsign.Decode(b)
+		if block == nil {
+			t.Fatal("InRelease not signed")
+		}
+		if _, err := openpgp.CheckDetachedSignature(openpgp.EntityList{key}, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil); err != nil {
+			t.Fatal(err)
+		}
+		// InRelease and Release.gpg are signed with signing subkey
+		subkey := key.Subkeys[len(key.Subkeys)-1].PublicKey.KeyId
+		block, _ = clearsign.Decode(b)
+		gpg, _ := os.ReadFile(filepath.Join(repoDir, "dists/stable/Release.gpg"))
+		detached, err := armor.Decode(bytes.NewReader(gpg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, r := range map[string]io.Reader{"InRelease": block.ArmoredSignature.Body, "Release.gpg": detached.Body} {
+			p, err := packet.Read(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig, ok := p.(*packet.Signature); !ok || sig.IssuerKeyId == nil || *sig.IssuerKeyId != subkey {
+				t.Fatalf("%s not signed with signing subkey", name)
+			}
+		}
+	})
+	for _, tt := range []struct {
+		name, artifact string
+		deb            []byte
+		err            error
+	}{
+		{"exists", "stable/main/daemon.deb", daemon, AptPackageExists},
+		{"distribution", "unstable/main/daemon.deb", daemon, AptPackageNotValid},
+		{"path", "daemon.deb", daemon, AptPackageNotValid},
+		{"not deb", "stable/main/daemon.deb", []byte("text"), AptPackageNotValid},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := upload(tt.artifact, tt.deb); !errors.Is(err, tt.err) {
+				t.Fatalf("expected: '%v', got: '%v'", tt.err, err)
+			}
+		})
+	}
+	t.Run("concurrent", func(t *testing.T) {
+		tool := testDeb(t, "Package: tool\nVersion: 1.0\nArchitecture: amd64\n")
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- upload("stable/main/tool.deb", tool)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		published := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				published++
+			case !errors.Is(err, AptPackageExists):
+				t.Fatal(err)
+			}
+		}
+		if published != 1 {
+			t.Fatalf("package published: '%d' times", published)
+		}
+	})
+}
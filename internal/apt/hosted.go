@@ -0,0 +1,478 @@
+package apt
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/klauspost/compress/zstd"
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+	"github.com/ulikunitz/xz"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	AptPackageNotValid = errors.New("apt package is invalid")
+	AptPackageExists   = errors.New("cannot publish over existing apt package")
+)
+
+// Indexes of hosted repository are generated by one upload at a time
+var indexMutex sync.Mutex
+
+// Checksums listed in Packages and Release
+var checksums = []struct {
+	release, packages string
+	hash              func() hash.Hash
+}{
+	{"MD5Sum", "MD5sum", md5.New},
+	{"SHA1", "SHA1", sha1.New},
+	{"SHA256", "SHA256", sha256.New},
+}
+
+// Control of binary package with fields used for pool path
+type control struct {
+	Package, Version, Architecture string
+	// Paragraph of control file without trailing newline
+	Paragraph string
+}
+
+// Read control file from control.tar(.gz|.xz|.zst) member of deb (ar archive)
+func debControl(f string) (control, error) {
+	src, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return control{}, err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	r := bufio.NewReader(src)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "!<arch>\n" {
+		return control{}, fmt.Errorf("%w: '%s' is not deb archive", AptPackageNotValid, f)
+	}
+	header := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return control{}, fmt.Errorf("%w: control.tar not found in: '%s'", AptPackageNotValid, f)
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return control{}, fmt.Errorf("%w: member: '%s' has invalid size", AptPackageNotValid, name)
+		}
+		member := io.LimitReader(r, size)
+		switch name {
+		case "control.tar":
+			return readControl(member)
+		case "control.tar.gz":
+			gz, err := gzip.NewReader(member)
+			if err != nil {
+				return control{}, fmt.Errorf("%w: %v", AptPackageNotValid, err)
+			}
+			return readControl(gz)
+		case "control.tar.xz":
+			xr, err := xz.NewReader(member)
+			if err != nil {
+				return control{}, fmt.Errorf("%w: %v", AptPackageNotValid, err)
+			}
+			return readControl(xr)
+		case "control.tar.zst":
+			zr, err := zstd.NewReader(member)
+			if err != nil {
+				return control{}, fmt.Errorf("%w: %v", AptPackageNotValid, err)
+			}
+			defer zr.Close()
+			return readControl(zr)
+		}
+		// Members are aligned to even offset
+		if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+			return control{}, fmt.Errorf("%w: %v", AptPackageNotValid, err)
+		}
+	}
+}
+
+// Parse control file from control tar
+func readControl(src io.Reader) (control, error) {
+	tr := tar.NewReader(src)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			return control{}, fmt.Errorf("%w: control file not found", AptPackageNotValid)
+		}
+		if path.Clean(h.Name) != "control" {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return control{}, err
+		}
+		return parseControl(strings.TrimSpace(string(b)))
+	}
+}
+
+// Fields of control paragraph used for pool path
+func parseControl(paragraph string) (control, error) {
+	c := control{Paragraph: paragraph}
+	for _, line := range strings.Split(paragraph, "\n") {
+		field, value, _ := strings.Cut(line, ":")
+		switch field {
+		case "Package":
+			c.Package = strings.TrimSpace(value)
+		case "Version":
+			c.Version = strings.TrimSpace(value)
+		case "Architecture":
+			c.Architecture = strings.TrimSpace(value)
+		}
+	}
+	if c.Package == "" || c.Version == "" || c.Architecture == "" || strings.ContainsAny(c.Package+c.Version+c.Architecture, "/\\") {
+		return control{}, fmt.Errorf("%w: control has no valid Package, Version or Architecture", AptPackageNotValid)
+	}
+	return c, nil
+}
+
+// Pool path of package relative to repository:
+// pool/{dist}/{component}/{h|libh}/{package}/{package}_{version}_{arch}.deb
+func (c control) poolPath(dist, component string) string {
+	prefix := c.Package[:1]
+	if strings.HasPrefix(c.Package, "lib") && len(c.Package) > 3 {
+		prefix = c.Package[:4]
+	}
+	// Epoch is not part of file name
+	_, version, ok := strings.Cut(c.Version, ":")
+	if !ok {
+		version = c.Version
+	}
+	return path.Join("pool", dist, component, prefix, c.Package, fmt.Sprintf("%s_%s_%s.deb", c.Package, version, c.Architecture))
+}
+
+// Hidden file near package with Packages stanza: dir/.name.control
+func stanzaPath(f string) string {
+	return filepath.Join(filepath.Dir(f), "."+filepath.Base(f)+".control")
+}
+
+// Packages stanza of package in pool, kept near package after first read
+func stanza(f, filename string) (string, control, error) {
+	if b, err := os.ReadFile(filepath.Clean(stanzaPath(f))); err == nil {
+		c, err := parseControl(string(b))
+		return string(b), c, err
+	}
+	c, err := debControl(f)
+	if err != nil {
+		return "", c, err
+	}
+	fi, err := os.Stat(f)
+	if err != nil {
+		return "", c, err
+	}
+	s := fmt.Sprintf("%s\nFilename: %s\nSize: %d\n", c.Paragraph, filename, fi.Size())
+	for _, cs := range checksums {
+		sum, err := file.Digest(f, cs.hash())
+		if err != nil {
+			return "", c, err
+		}
+		s += fmt.Sprintf("%s: %s\n", cs.packages, sum)
+	}
+	if err := file.WriteFile(stanzaPath(f), []byte(s)); err != nil {
+		return "", c, err
+	}
+	return s, c, nil
+}
+
+// Write Packages and Packages.gz of component for each architecture, packages
+// with architecture all are listed for every architecture
+func writePackages(repoDir, dist, component string, archs []string) error {
+	type entry struct {
+		control
+		stanza string
+	}
+	entries := []entry{}
+	pool := filepath.Join(repoDir, "pool", dist, component)
+	err := filepath.WalkDir(pool, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(p) != ".deb" || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(repoDir, p)
+		if err != nil {
+			return err
+		}
+		s, c, err := stanza(p, filepath.ToSlash(rel))
+		if err != nil {
+			log.Errorf("package: '%s' skipped in index. Error: '%v'", p, err)
+			return nil
+		}
+		entries = append(entries, entry{c, s})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Package != entries[j].Package {
+			return entries[i].Package < entries[j].Package
+		}
+		return entries[i].stanza < entries[j].stanza
+	})
+	for _, arch := range archs {
+		var b bytes.Buffer
+		for _, e := range entries {
+			if e.Architecture != arch && e.Architecture != "all" {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString(e.stanza)
+		}
+		dir := filepath.Join(repoDir, "dists", dist, component, "binary-"+arch)
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		if err := file.WriteFile(filepath.Join(dir, "Packages"), b.Bytes()); err != nil {
+			return err
+		}
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		if _, err := zw.Write(b.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := file.WriteFile(filepath.Join(dir, "Packages.gz"), gz.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release of distribution with checksums of all indexes
+func writeRelease(repoDir, name, dist string, repo project.Repos) ([]byte, error) {
+	distDir := filepath.Join(repoDir, "dists", dist)
+	files := []string{}
+	for _, component := range repo.Comps() {
+		for _, arch := range repo.Archs() {
+			for _, f := range []string{"Packages", "Packages.gz"} {
+				files = append(files, path.Join(component, "binary-"+arch, f))
+			}
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Origin: yaam2\nLabel: %s\nSuite: %s\nCodename: %s\n", name, dist, dist)
+	fmt.Fprintf(&b, "Date: %s\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Architectures: %s\nComponents: %s\n", strings.Join(repo.Archs(), " "), strings.Join(repo.Comps(), " "))
+	for _, cs := range checksums {
+		fmt.Fprintf(&b, "%s:\n", cs.release)
+		for _, f := range files {
+			p := filepath.Join(distDir, filepath.FromSlash(f))
+			size, _ := file.Exists(p)
+			sum, err := file.Digest(p, cs.hash())
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, " %s %d %s\n", sum, size, f)
+		}
+	}
+	return b.Bytes(), file.WriteFile(filepath.Join(distDir, "Release"), b.Bytes())
+}
+
+// Private key from armored key file, decrypted with passphrase
+func signingKey(f, pass string) (*openpgp.Entity, error) {
+	src, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	keys, err := openpgp.ReadArmoredKeyRing(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range keys {
+		if e.PrivateKey == nil {
+			continue
+		}
+		// Signing subkeys are decrypted too
+		if err := e.DecryptPrivateKeys([]byte(pass)); err != nil {
+			return nil, fmt.Errorf("signing key: '%s' can not be decrypted. Error: '%v'", f, err)
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("signing key: '%s' has no private key", f)
+}
+
+// Write InRelease and Release.gpg signed with key of repository
+func signRelease(distDir string, release []byte, repo project.Repos) error {
+	inRelease, releaseGpg := filepath.Join(distDir, "InRelease"), filepath.Join(distDir, "Release.gpg")
+	if repo.SigningKey == "" {
+		log.Warnf("signingkey not configured, release: '%s' is not signed", distDir)
+		for _, f := range []string{inRelease, releaseGpg} {
+			if err := storage.Remove(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	key, err := signingKey(repo.SigningKey, repo.SigningKeyPass)
+	if err != nil {
+		return err
+	}
+	// Signing subkey if key has one, Release.gpg is signed with it too
+	signer, ok := key.SigningKey(time.Now())
+	if !ok || signer.PrivateKey == nil {
+		return fmt.Errorf("signing key: '%s' can not sign", repo.SigningKey)
+	}
+	var signed bytes.Buffer
+	w, err := clearsign.Encode(&signed, signer.PrivateKey, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(release); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := file.WriteFile(inRelease, signed.Bytes()); err != nil {
+		return err
+	}
+	var detached bytes.Buffer
+	config := &packet.Config{SigningKeyId: signer.PrivateKey.KeyId}
+	if err := openpgp.ArmoredDetachSign(&detached, key, bytes.NewReader(release), config); err != nil {
+		return err
+	}
+	return file.WriteFile(releaseGpg, detached.Bytes())
+}
+
+// Regenerate Packages, Packages.gz, Release and signed InRelease of
+// distribution after upload, indexMutex is held by caller
+func updateIndexes(repoDir, name, dist string, repo project.Repos) error {
+	// Packages uploaded to other replicas are indexed too
+	if err := storage.SyncDir(filepath.Join(repoDir, "pool", dist)); err != nil {
+		return err
+	}
+	for _, component := range repo.Comps() {
+		if err := writePackages(repoDir, dist, component, repo.Archs()); err != nil {
+			return err
+		}
+	}
+	release, err := writeRelease(repoDir, name, dist, repo)
+	if err != nil {
+		return err
+	}
+	if err := signRelease(filepath.Join(repoDir, "dists", dist), release, repo); err != nil {
+		return err
+	}
+	log.Debugf("indexes of distribution: '%s' of: '%s' updated", dist, name)
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Store package uploaded to {dist}/{component}/{name}.deb in pool of hosted
+// repository and regenerate indexes of distribution
+func publish(name, artifact string, body io.Reader) error {
+	repo := project.Conf.Caches.Apt[name]
+	parts := strings.Split(strings.Trim(artifact, "/"), "/")
+	if len(parts) != 3 || filepath.Ext(parts[2]) != ".deb" {
+		return fmt.Errorf("%w: upload path: '%s' is not {distribution}/{component}/{name}.deb", AptPackageNotValid, artifact)
+	}
+	dist, component := parts[0], parts[1]
+	if !contains(repo.Dists(), dist) || !contains(repo.Comps(), component) {
+		return fmt.Errorf("%w: distribution: '%s' or component: '%s' not configured", AptPackageNotValid, dist, component)
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return err
+	}
+	repoDir := filepath.Join(h, "apt", name)
+	if err := os.MkdirAll(repoDir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := file.CreateTemp(filepath.Join(repoDir, "upload.deb"))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Error(err)
+		}
+	}()
+	if _, err := io.Copy(tmp, body); err != nil {
+		return closeWith(tmp, err)
+	}
+	if err := tmp.Chmod(storage.FileMode); err != nil {
+		return closeWith(tmp, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	c, err := debControl(tmp.Name())
+	if err != nil {
+		return err
+	}
+	pool := c.poolPath(dist, component)
+	dst := filepath.Join(repoDir, filepath.FromSlash(pool))
+	// Concurrent uploads of same package must not both pass exists check
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+	fileExists, err := storage.Restore(dst)
+	if err != nil {
+		return err
+	}
+	if fileExists {
+		return fmt.Errorf("%w: '%s'", AptPackageExists, pool)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	// Package is stored in backend before it is in cache
+	if err := storage.UploadAs(tmp.Name(), dst); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	log.Infof("apt package: '%s_%s_%s' published to: '%s/%s'", c.Package, c.Version, c.Architecture, name, dist)
+	return storage.RetryOnConflict(func() error { return updateIndexes(repoDir, name, dist, repo) })
+}
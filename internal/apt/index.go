@@ -0,0 +1,113 @@
+package apt
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// File listed in Release with size and SHA256
+type releaseEntry struct {
+	Sha256 string
+	Size   int64
+}
+
+// Release or InRelease of suite
+type release struct {
+	ByHash bool
+	Files  map[string]releaseEntry
+}
+
+// Release files change in upstream and are revalidated after max age
+func isRelease(f string) bool {
+	switch filepath.Base(f) {
+	case "InRelease", "Release", "Release.gpg":
+		return strings.Contains(filepath.ToSlash(f), "/dists/")
+	}
+	return false
+}
+
+// Index files of suite: Packages, Sources, Contents, Translation...
+func isIndex(f string) bool {
+	return strings.Contains(filepath.ToSlash(f), "/dists/") && !isByHash(f)
+}
+
+// by-hash files are addressed by checksum and never change
+func isByHash(f string) bool {
+	return strings.Contains(filepath.ToSlash(f), "/by-hash/")
+}
+
+// Expected SHA256 from path of by-hash file, empty for other hashes
+func byHashSha256(f string) string {
+	dir := filepath.Base(filepath.Dir(f))
+	if dir != "SHA256" {
+		return ""
+	}
+	return filepath.Base(f)
+}
+
+// Find cached InRelease or Release of suite for index file, return path of
+// release and path of index file relative to suite
+func releaseFor(f string) (string, string, bool) {
+	dir := filepath.Dir(f)
+	for filepath.Base(dir) != "dists" && dir != filepath.Dir(dir) {
+		for _, name := range []string{"InRelease", "Release"} {
+			rf := filepath.Join(dir, name)
+			if _, err := os.Stat(rf); err == nil {
+				rel, err := filepath.Rel(dir, f)
+				if err != nil {
+					return "", "", false
+				}
+				return rf, filepath.ToSlash(rel), true
+			}
+		}
+		dir = filepath.Dir(dir)
+	}
+	return "", "", false
+}
+
+// Parse SHA256 section and Acquire-By-Hash of Release or clearsigned InRelease
+func parseRelease(f string) (release, error) {
+	r := release{Files: map[string]releaseEntry{}}
+	src, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return r, err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	field := ""
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "-----BEGIN PGP SIGNATURE-----") {
+			break
+		}
+		if strings.HasPrefix(line, " ") {
+			if field != "SHA256" {
+				continue
+			}
+			parts := strings.Fields(line)
+			if len(parts) != 3 {
+				continue
+			}
+			size, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			r.Files[parts[2]] = releaseEntry{Sha256: strings.ToLower(parts[0]), Size: size}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		field = name
+		if name == "Acquire-By-Hash" {
+			r.ByHash = strings.TrimSpace(value) == "yes"
+		}
+	}
+	return r, scanner.Err()
+}
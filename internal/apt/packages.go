@@ -0,0 +1,229 @@
+package apt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/ulikunitz/xz"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Package files are stored in pool of archive
+func isPool(f string) bool {
+	return strings.Contains(filepath.ToSlash(f), "/pool/") && !isIndex(f)
+}
+
+// Root of archive and path of pool file relative to root as in Filename of
+// Packages: {root}/pool/main/h/hello/hello_1.0_amd64.deb
+func poolPath(f string) (string, string) {
+	slash := filepath.ToSlash(f)
+	i := strings.LastIndex(slash, "/pool/")
+	return filepath.FromSlash(slash[:i]), slash[i+1:]
+}
+
+// Cached Packages index, compressed or addressed by hash
+func isPackages(f string) bool {
+	if strings.HasPrefix(filepath.Base(f), ".") {
+		return false
+	}
+	switch filepath.Base(f) {
+	case "Packages", "Packages.gz", "Packages.xz":
+		return true
+	}
+	return byHashSha256(f) != "" && strings.Contains(filepath.ToSlash(f), "/binary-")
+}
+
+// Open index, gzip and xz are decompressed. Other compressions are not
+// supported.
+func openPackages(f string) (io.ReadCloser, error) {
+	src, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, closeWith(src, err)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{gz, src}, nil
+	}
+	if len(magic) == 2 && magic[0] == 0xfd && magic[1] == '7' {
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, closeWith(src, err)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{xr, src}, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, src}, nil
+}
+
+func closeWith(c io.Closer, err error) error {
+	if cerr := c.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Walk of Packages indexes is stopped at first index listing pool file
+var errFound = errors.New("pool file found in index")
+
+// Entries of Packages index by Filename, rebuilt when index changes
+type packagesLookup struct {
+	version string
+	entries map[string]releaseEntry
+}
+
+var (
+	lookupsMutex sync.Mutex
+	lookups      = map[string]packagesLookup{}
+)
+
+// Version of cached index from verified digest in state, size and
+// modification time
+func packagesVersion(f string) (string, error) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%x-%x", file.ReadState(f).Digest, fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// Read SHA256 and size of all Filenames in Packages index
+func readPackages(f string) (map[string]releaseEntry, error) {
+	src, err := openPackages(f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	entries := map[string]releaseEntry{}
+	e, name := releaseEntry{}, ""
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if name != "" {
+				entries[name] = e
+			}
+			e, name = releaseEntry{}, ""
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch field {
+		case "Filename":
+			name = value
+		case "SHA256":
+			e.Sha256 = strings.ToLower(value)
+		case "Size":
+			e.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if name != "" {
+		entries[name] = e
+	}
+	return entries, nil
+}
+
+// Find SHA256 and size of Filename in Packages index, index is parsed once
+// per version
+func packagesEntry(f, filename string) (releaseEntry, bool, error) {
+	version, err := packagesVersion(f)
+	if err != nil {
+		lookupsMutex.Lock()
+		delete(lookups, f)
+		lookupsMutex.Unlock()
+		return releaseEntry{}, false, err
+	}
+	lookupsMutex.Lock()
+	l, ok := lookups[f]
+	lookupsMutex.Unlock()
+	if !ok || l.version != version {
+		entries, err := readPackages(f)
+		if err != nil {
+			return releaseEntry{}, false, err
+		}
+		l = packagesLookup{version: version, entries: entries}
+		lookupsMutex.Lock()
+		lookups[f] = l
+		pruneLookups()
+		lookupsMutex.Unlock()
+		log.Tracef("index: '%s' with: '%d' packages loaded", f, len(entries))
+	}
+	e, ok := l.entries[filename]
+	return e, ok, nil
+}
+
+// Remove lookups of indexes evicted or removed from cache, lookupsMutex is
+// held by caller
+func pruneLookups() {
+	for f := range lookups {
+		if _, err := os.Stat(f); errors.Is(err, fs.ErrNotExist) {
+			delete(lookups, f)
+		}
+	}
+}
+
+// Expected SHA256 and size of pool file from cached Packages indexes of all
+// suites in archive
+func poolEntry(f string) (releaseEntry, bool, error) {
+	root, filename := poolPath(f)
+	dists := filepath.Join(root, "dists")
+	if _, err := os.Stat(dists); err != nil {
+		return releaseEntry{}, false, nil
+	}
+	var e releaseEntry
+	err := filepath.WalkDir(dists, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isPackages(p) {
+			return nil
+		}
+		pe, ok, err := packagesEntry(p, filename)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ok && pe.Sha256 != "" {
+			e = pe
+			return errFound
+		}
+		return nil
+	})
+	if errors.Is(err, errFound) {
+		return e, true, nil
+	}
+	return releaseEntry{}, false, err
+}
@@ -1,6 +1,7 @@
 package artifact
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/morhayn/yaam2/internal/eviction"
 	"github.com/morhayn/yaam2/internal/file"
 	"github.com/morhayn/yaam2/internal/project"
 
@@ -18,7 +20,36 @@ type Artefact struct {
 	Path, Url string
 }
 type PublicRepository struct {
-	Name, Url, User, Pass string
+	Name, Url, User, Pass, Token string
+	Mirrors                      []PublicRepository
+	Headers                      http.Header
+	Client                       project.HttpClient
+}
+
+// Download url from upstream with client and credentials of repository,
+// mirrors are tried with their own credentials if upstream fails
+func (r PublicRepository) Download(url string) (*http.Response, error) {
+	return r.failover(url, func(m PublicRepository, url string) (*http.Response, error) {
+		return file.DownloadWithRetries(url, m.Client, m.Header())
+	})
+}
+
+// Header of requests to upstream with configured headers and bearer token or
+// basic auth, Authorization of configured headers is kept
+func (r PublicRepository) Header() http.Header {
+	h := r.Headers.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if h.Get("Authorization") != "" {
+		return h
+	}
+	if r.Token != "" {
+		h.Set("Authorization", "Bearer "+r.Token)
+	} else if r.User != "" && r.Pass != "" {
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(r.User+":"+r.Pass)))
+	}
+	return h
 }
 
 // Create new structure
@@ -39,23 +70,11 @@ func NewArtefact(url, artifact string, repos PublicRepository) (Artefact, error)
 // Create file if not exists
 func createIfDoesNotExist(path string, requestBody io.ReadCloser) error {
 	if _, fileExists := file.Exists(path); !fileExists {
-		dst, err := os.Create(filepath.Clean(path))
+		w, err := file.WriteAtomic(path, requestBody)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := dst.Close(); err != nil {
-				panic(err)
-			}
-		}()
-		w, err := io.Copy(dst, requestBody)
-		if err != nil {
-			log.Error(err)
-		}
 		log.Debugf("file: '%s' created and it contains: '%d' bytes", path, w)
-		if err := dst.Sync(); err != nil {
-			return err
-		}
 	} else {
 		log.Tracef("file: '%s' exists already", path)
 	}
@@ -90,32 +109,85 @@ func filepathOnDisk(url string) (string, error) {
 	return f, nil
 }
 
-// Read and send to Response file
-func ReadFromDisk(w http.ResponseWriter, reqURL string) error {
+// Content types of artifacts, other files are sent as octet-stream
+var contentTypes = map[string]string{
+	".tmp":    "application/json",
+	".json":   "application/json",
+	".module": "application/json",
+	".tgz":    "application/octet-stream",
+	".jar":    "application/java-archive",
+	".war":    "application/java-archive",
+	".ear":    "application/java-archive",
+	".aar":    "application/java-archive",
+	".pom":    "application/xml",
+	".xml":    "application/xml",
+	".deb":    "application/vnd.debian.binary-package",
+	".udeb":   "application/vnd.debian.binary-package",
+	".dsc":    "text/plain; charset=utf-8",
+	".gz":     "application/gzip",
+	".xz":     "application/x-xz",
+	".bz2":    "application/x-bzip2",
+	".zst":    "application/zstd",
+	".asc":    "application/pgp-signature",
+	".gpg":    "application/pgp-signature",
+	".md5":    "text/plain; charset=utf-8",
+	".sha1":   "text/plain; charset=utf-8",
+	".sha256": "text/plain; charset=utf-8",
+	".sha512": "text/plain; charset=utf-8",
+}
+
+// Content type of file by extension, apt indexes without extension are text
+func contentType(f string) string {
+	if ct, ok := contentTypes[filepath.Ext(f)]; ok {
+		return ct
+	}
+	switch filepath.Base(f) {
+	case "InRelease", "Release", "Packages", "Sources", "Index":
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// Strong validator of file from size and modification time
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// Stream file to Response. Range, If-Range and conditional requests are
+// handled by http.ServeContent, r may be nil.
+func ReadFromDisk(w http.ResponseWriter, r *http.Request, reqURL string) error {
 	f, err := filepathOnDisk(reqURL)
 	if err != nil {
 		return err
 	}
 	log.Tracef("reading file: '%s' from disk...", f)
-
-	if filepath.Ext(f) == ".tmp" {
-		w.Header().Set("Content-Type", "application/json")
-	}
-	if filepath.Ext(f) == ".tgz" {
-		w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := Restore(f); err != nil {
+		return err
 	}
-	size, ok := file.Exists(f)
-	if !ok {
-		return errors.New(fmt.Sprintf("File not exists %s", f))
+
+	src, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return fmt.Errorf("file: '%s' not exists. Error: '%w'", f, err)
 	}
-	w.Header().Set("Content-Length", fmt.Sprint(size))
-	b, err := os.ReadFile(filepath.Clean(f))
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fi, err := src.Stat()
 	if err != nil {
 		return err
 	}
-	if _, err := io.WriteString(w, string(b)); err != nil {
-		return err
+	if fi.IsDir() {
+		return fmt.Errorf("file: '%s' is a directory", f)
+	}
+	eviction.Touch(f)
+	if r == nil {
+		r = &http.Request{Method: http.MethodGet, Header: http.Header{}}
 	}
+	w.Header().Set("Content-Type", contentType(f))
+	w.Header().Set("ETag", etag(fi))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), src)
 
 	return nil
 }
@@ -148,15 +220,35 @@ func RepoInConfigFile(urlString, repo string, configRepos map[string]project.Rep
 
 	log.Debugf("trying to cache artifact from: '%s'...", urlString)
 
-	pr := PublicRepository{Name: repo, Url: url}
+	pr := PublicRepository{Name: repo, Url: url, Token: string(r.Token), Headers: headers(r.Headers), Client: r.Client}
 	if user != "" && pass != "" {
-		pr.User = user
-		pr.Pass = pass
+		pr.User = string(user)
+		pr.Pass = string(pass)
+	}
+	for _, m := range r.Mirrors {
+		mirror := PublicRepository{Name: repo, Url: CloseUrlRepo(m.Url), Token: string(m.Token), Headers: headers(m.Headers), Client: r.Client}
+		if m.User != "" && m.Pass != "" {
+			mirror.User = string(m.User)
+			mirror.Pass = string(m.Pass)
+		}
+		pr.Mirrors = append(pr.Mirrors, mirror)
 	}
 
 	return pr, nil
 }
 
+// Headers of upstream from config file, nil if none
+func headers(secrets map[string]project.Secret) http.Header {
+	if len(secrets) == 0 {
+		return nil
+	}
+	h := http.Header{}
+	for k, v := range secrets {
+		h.Set(k, string(v))
+	}
+	return h
+}
+
 // Create directoryes
 func DirCreate(url string) error {
 	path, err := filepathOnDisk(url)
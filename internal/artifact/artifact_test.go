@@ -1,13 +1,20 @@
 package artifact
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/morhayn/yaam2/internal/file"
 	"github.com/morhayn/yaam2/internal/project"
 )
 
@@ -35,7 +42,7 @@ func TestRepoInConfigure(t *testing.T) {
 			User: "user",
 			Pass: "12345",
 		}
-		if pr != repo {
+		if !reflect.DeepEqual(pr, repo) {
 			t.Fatal("Response not wrong ", pr)
 		}
 	})
@@ -61,7 +68,7 @@ func TestRepoInConfigure(t *testing.T) {
 			User: "",
 			Pass: "",
 		}
-		if pr != repo {
+		if !reflect.DeepEqual(pr, repo) {
 			t.Fatal("Response not wrong ", pr)
 		}
 	})
@@ -112,6 +119,33 @@ func TestRepoInConfigure(t *testing.T) {
 		}
 
 	})
+	t.Run("token and headers", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("Private-Token"))
+		}))
+		defer ts.Close()
+		repos := map[string]project.Repos{
+			"gitlab": {Url: ts.URL, Headers: map[string]project.Secret{"private-token": "glpat"}},
+			"npmjs":  {Url: ts.URL, User: "user", Pass: "12345", Token: "npm_token"},
+			"nexus":  {Url: ts.URL, User: "user", Pass: "12345"},
+		}
+		expected := map[string]string{"gitlab": "|glpat", "npmjs": "Bearer npm_token|", "nexus": "Basic dXNlcjoxMjM0NQ==|"}
+		for name, e := range expected {
+			pr, err := RepoInConfigFile("lodash", name, repos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := pr.Download(pr.Url + "lodash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(b) != e {
+				t.Fatalf("headers of: '%s' are: '%s', expected: '%s'", name, b, e)
+			}
+		}
+	})
 }
 func TestCloseUrlPath(t *testing.T) {
 	t.Run("url close", func(t *testing.T) {
@@ -214,3 +248,297 @@ func TestNewArtifact(t *testing.T) {
 		}
 	})
 }
+func TestReadFromDisk(t *testing.T) {
+	project.Conf.CacheDir = t.TempDir()
+	if err := StoreOnDisk("maven/central/lib-1.0.jar", io.NopCloser(strings.NewReader("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+	read := func(t *testing.T, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/maven/central/lib-1.0.jar", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		if err := ReadFromDisk(w, r, "maven/central/lib-1.0.jar"); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	w := read(t, nil)
+	t.Run("full", func(t *testing.T) {
+		if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Content-Type") != "application/java-archive" {
+			t.Fatal("wrong response ", w.Code, w.Header(), w.Body.String())
+		}
+		if w.Header().Get("ETag") == "" || w.Header().Get("Last-Modified") == "" {
+			t.Fatal("validators not sent ", w.Header())
+		}
+	})
+	t.Run("range", func(t *testing.T) {
+		r := read(t, http.Header{"Range": {"bytes=2-4"}})
+		if r.Code != http.StatusPartialContent || r.Body.String() != "234" {
+			t.Fatal("wrong range ", r.Code, r.Body.String())
+		}
+	})
+	t.Run("if-range changed", func(t *testing.T) {
+		r := read(t, http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"other"`}})
+		if r.Code != http.StatusOK || r.Body.String() != "0123456789" {
+			t.Fatal("wrong if-range ", r.Code, r.Body.String())
+		}
+	})
+	t.Run("not modified", func(t *testing.T) {
+		r := read(t, http.Header{"If-None-Match": {w.Header().Get("ETag")}})
+		if r.Code != http.StatusNotModified || r.Body.Len() != 0 {
+			t.Fatal("wrong conditional response ", r.Code)
+		}
+	})
+	t.Run("not exists", func(t *testing.T) {
+		if err := ReadFromDisk(httptest.NewRecorder(), nil, "maven/central/none.jar"); err == nil {
+			t.Fatal("file found")
+		}
+	})
+}
+func TestStream(t *testing.T) {
+	project.Conf.CacheDir = t.TempDir()
+	f := filepath.Join(project.Conf.CacheDir, "lib-1.0.jar")
+	for _, tt := range []struct {
+		name   string
+		length int64
+		err    error
+		cached bool
+	}{
+		{name: "cached", length: 10, cached: true},
+		{name: "unknown length", length: -1, cached: true},
+		{name: "truncated", length: 20},
+		{name: "not valid", length: 10, err: file.CheckSumNotValid},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(f)
+			w := &Response{ResponseWriter: httptest.NewRecorder()}
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader("0123456789")), ContentLength: tt.length}
+			err := Stream(w, resp, f, func(tmp string) error { return tt.err })
+			if (err == nil) != tt.cached {
+				t.Fatal("wrong error ", err)
+			}
+			if !Sent(w) || w.ResponseWriter.(*httptest.ResponseRecorder).Body.String() != "0123456789" {
+				t.Fatal("artifact not sent to client")
+			}
+			if _, fileExists := file.Exists(f); fileExists != tt.cached {
+				t.Fatalf("file exists: '%t'", fileExists)
+			}
+			if parts, _ := filepath.Glob(filepath.Join(project.Conf.CacheDir, ".*.part")); len(parts) > 0 {
+				t.Fatal("temporary file not removed ", parts)
+			}
+		})
+	}
+	t.Run("streamable", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/maven/central/lib-1.0.jar", nil)
+		if Streamable(httptest.NewRecorder(), r) || !Streamable(&Response{}, r) {
+			t.Fatal("wrong streamable")
+		}
+		r.Header.Set("Range", "bytes=0-1")
+		if Streamable(&Response{}, r) {
+			t.Fatal("range request streamed")
+		}
+	})
+}
+func TestFetch(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- Fetch("maven/central/lib-1.0.jar", func() error {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return file.CheckSumNotValid
+			})
+		}()
+	}
+	// Callers wait for fetch in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 10; i++ {
+		if err := <-errs; !errors.Is(err, file.CheckSumNotValid) {
+			t.Fatal("result of fetch not shared ", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("fetch in flight not shared, calls: '%d'", calls)
+	}
+	t.Run("next fetch", func(t *testing.T) {
+		if err := Fetch("maven/central/lib-1.0.jar", func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("offline", func(t *testing.T) {
+		project.Conf = project.ConfigFile{
+			CacheDir: t.TempDir(),
+			Caches:   project.Rep{Maven: map[string]project.Repos{"central": {Url: "https://repo.maven.apache.org/maven2/", Offline: true}}},
+		}
+		h, _ := project.RepositoriesHome()
+		cached := filepath.Join(h, "maven", "central", "lib", "1.0", "lib-1.0.jar")
+		if err := os.MkdirAll(filepath.Dir(cached), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cached, []byte("jar"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		upstream := func() error {
+			t.Fatal("upstream fetched offline")
+			return nil
+		}
+		if err := Fetch(cached, upstream); err != nil {
+			t.Fatal(err)
+		}
+		err := Fetch(filepath.Join(h, "maven", "central", "lib", "2.0", "lib-2.0.jar"), upstream)
+		if !errors.Is(err, OfflineNotCached) || !strings.Contains(err.Error(), "'maven/central/lib/2.0/lib-2.0.jar'") {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestNotFound(t *testing.T) {
+	dir := t.TempDir()
+	a := Artefact{Path: filepath.Join(dir, "maven/central/lib/1.0/lib-1.0.jar"), Url: "https://repo/lib/1.0/lib-1.0.jar"}
+	if err := RememberNotFound(a, time.Minute); !errors.Is(err, NotFoundUpstream) {
+		t.Fatal(err)
+	}
+	t.Run("remembered", func(t *testing.T) {
+		err := Fetch(a.Path, func() error {
+			t.Fatal("upstream requested")
+			return nil
+		})
+		if !errors.Is(err, NotFoundUpstream) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("flush", func(t *testing.T) {
+		if n := FlushNotFound(filepath.Join(dir, "maven/cent")); n != 0 {
+			t.Fatalf("flushed: '%d' of other repository", n)
+		}
+		if n := FlushNotFound(filepath.Join(dir, "maven/central")); n != 1 || NotFound(a.Path) {
+			t.Fatalf("flushed: '%d'", n)
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		RememberNotFound(a, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		if NotFound(a.Path) || len(NotFoundEntries()) != 0 {
+			t.Fatal("expired entry remembered")
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		RememberNotFound(a, 0)
+		if NotFound(a.Path) {
+			t.Fatal("entry remembered without ttl")
+		}
+	})
+	t.Run("cap", func(t *testing.T) {
+		defer func(n int) { maxNotFound = n }(maxNotFound)
+		maxNotFound = 10
+		for i := 0; i < 25; i++ {
+			b := Artefact{Path: filepath.Join(dir, fmt.Sprintf("npm/npmjs/pkg-%d", i))}
+			RememberNotFound(b, time.Minute+time.Duration(i)*time.Second)
+			if n := len(NotFoundEntries()); n > maxNotFound {
+				t.Fatalf("remembered: '%d' entries over cap", n)
+			}
+		}
+		if !NotFound(filepath.Join(dir, "npm/npmjs/pkg-24")) || NotFound(filepath.Join(dir, "npm/npmjs/pkg-0")) {
+			t.Fatal("newest entry evicted or oldest kept")
+		}
+		FlushNotFound(dir)
+	})
+}
+
+func TestMirrors(t *testing.T) {
+	var primaryHits, mirrorHits int32
+	primaryDown := int32(1)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryHits, 1)
+		if atomic.LoadInt32(&primaryDown) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "primary "+r.URL.Path)
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorHits, 1)
+		// Credentials of primary are not sent to mirror
+		if r.Header.Get("Authorization") != "" || r.Header.Get("Private-Token") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "mirror "+r.URL.Path)
+	}))
+	defer mirror.Close()
+	// Failover without retries of primary, default backoff is 10s
+	repos := map[string]project.Repos{
+		"debian": {
+			Url:     primary.URL + "/debian",
+			Token:   "secret",
+			Headers: map[string]project.Secret{"Private-Token": "secret"},
+			Mirrors: []project.Mirror{{Url: mirror.URL + "/debian"}},
+		},
+	}
+	pr, err := RepoInConfigFile("dists/bookworm/Release", "debian", repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func() string {
+		resp, err := pr.Download(pr.Url + "dists/bookworm/Release")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	for i := 0; i < MirrorFailures+2; i++ {
+		if b := download(); b != "mirror /debian/dists/bookworm/Release" {
+			t.Fatalf("response: '%s' not from mirror", b)
+		}
+	}
+	if atomic.LoadInt32(&primaryHits) != int32(MirrorFailures) {
+		t.Fatalf("primary with open circuit requested: '%d' times", primaryHits)
+	}
+
+	t.Run("closed after cooldown", func(t *testing.T) {
+		cooldown := MirrorCooldown
+		defer func() { MirrorCooldown = cooldown }()
+		MirrorCooldown = 0
+		atomic.StoreInt32(&primaryDown, 0)
+		mirrorResult(pr.Url, true)
+		time.Sleep(time.Millisecond)
+		if b := download(); b != "primary /debian/dists/bookworm/Release" {
+			t.Fatalf("response: '%s' not from primary", b)
+		}
+		if !mirrorAvailable(pr.Url, time.Now()) {
+			t.Fatal("circuit of primary not closed")
+		}
+	})
+	t.Run("one probe after cooldown", func(t *testing.T) {
+		for i := 0; i < MirrorFailures; i++ {
+			mirrorResult(pr.Url, true)
+		}
+		defer mirrorResult(pr.Url, false)
+		later := time.Now().Add(2 * MirrorCooldown)
+		if !mirrorAvailable(pr.Url, later) || mirrorAvailable(pr.Url, later) {
+			t.Fatal("not exactly one request let through after cooldown")
+		}
+	})
+	t.Run("all unavailable", func(t *testing.T) {
+		for _, m := range []string{pr.Url, pr.Mirrors[0].Url} {
+			for i := 0; i < MirrorFailures; i++ {
+				mirrorResult(m, true)
+			}
+		}
+		defer func() {
+			mirrorResult(pr.Url, false)
+			mirrorResult(pr.Mirrors[0].Url, false)
+		}()
+		if _, err := pr.Download(pr.Url + "dists/bookworm/Release"); !errors.Is(err, MirrorsUnavailable) {
+			t.Fatal(err)
+		}
+	})
+}
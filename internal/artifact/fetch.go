@@ -0,0 +1,96 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OfflineNotCached is error of artifact missing in cache of offline repository
+var OfflineNotCached = errors.New("artifact not cached and repository is offline")
+
+// Path of file in cache relative to repositories home, {pack}/{repo}/...
+func repositoryPath(f string) ([]string, bool) {
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return nil, false
+	}
+	rel, err := filepath.Rel(h, f)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+	if len(parts) < 3 || parts[0] == ".." {
+		return nil, false
+	}
+	return parts, true
+}
+
+// Restore file missing in cache from storage, file of hosted repository is
+// checked with storage as other replicas may change or delete it
+func Restore(f string) (bool, error) {
+	if p, ok := repositoryPath(f); ok && project.Conf.IsHosted(p[0], p[1]) {
+		return storage.Refresh(f)
+	}
+	return storage.Restore(f)
+}
+
+// Fetch of cache key in flight, waiters get its result
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	flightsMutex sync.Mutex
+	flights      = map[string]*flight{}
+)
+
+// Fetch run fetch once for key (path of file in cache). Concurrent callers
+// with same key wait for fetch in flight and get its error, file fetched is
+// read from disk by them.
+func Fetch(key string, fetch func() error) error {
+	flightsMutex.Lock()
+	if f, ok := flights[key]; ok {
+		flightsMutex.Unlock()
+		log.Debugf("waiting for fetch of: '%s' in flight", key)
+		<-f.done
+		return f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	flights[key] = f
+	flightsMutex.Unlock()
+
+	defer func() {
+		flightsMutex.Lock()
+		delete(flights, key)
+		flightsMutex.Unlock()
+		close(f.done)
+	}()
+	// File cached by other replica is not fetched from upstream
+	cached, err := storage.Restore(key)
+	if err != nil {
+		log.Warnf("file: '%s' not restored from storage. Error: '%v'", key, err)
+	}
+	// Cached file is served as is and missing one is not fetched offline
+	if p, ok := repositoryPath(key); ok && project.Conf.IsOffline(p[0], p[1]) {
+		if !cached {
+			f.err = fmt.Errorf("%w: '%s'", OfflineNotCached, strings.Join(p, "/"))
+		}
+		return f.err
+	}
+	// Upstream responded 404 recently
+	if !cached && NotFound(key) {
+		f.err = fmt.Errorf("%w: '%s' remembered", NotFoundUpstream, key)
+		return f.err
+	}
+	f.err = fetch()
+	return f.err
+}
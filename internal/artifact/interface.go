@@ -34,3 +34,11 @@ type Reader interface {
 type Unifier interface {
 	Unify(name string) error
 }
+
+// Cleaner is the interface that wraps the basic Cleanup method.
+//
+// Cleanup deletes versions of hosted repository by retention rules, with
+// dryRun it only reports them.
+type Cleaner interface {
+	Cleanup(dryRun bool) ([]Deleted, error)
+}
@@ -0,0 +1,121 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MirrorsUnavailable is error of repository with all mirrors failing
+var MirrorsUnavailable = errors.New("all mirrors of repository unavailable")
+
+// Circuit of mirror opens after consecutive failures and one request is let
+// through after cooldown, success closes it
+var (
+	MirrorFailures = 3
+	MirrorCooldown = time.Minute
+)
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	// Request let through after cooldown is in flight
+	probing bool
+}
+
+// Breakers of mirrors, key is url of mirror
+var (
+	breakersMutex sync.Mutex
+	breakers      = map[string]*breaker{}
+)
+
+// Mirror may be requested: circuit is closed, or it is open with cooldown
+// over and no other request probes mirror
+func mirrorAvailable(mirror string, now time.Time) bool {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b, ok := breakers[mirror]
+	if !ok || b.failures < MirrorFailures {
+		return true
+	}
+	if b.probing || now.Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record result of request to mirror, circuit is opened again if request
+// after cooldown failed
+func mirrorResult(mirror string, failed bool) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b, ok := breakers[mirror]
+	if !ok {
+		b = &breaker{}
+		breakers[mirror] = b
+	}
+	if !failed {
+		if b.failures >= MirrorFailures {
+			log.Infof("mirror: '%s' available again", mirror)
+		}
+		delete(breakers, mirror)
+		return
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= MirrorFailures {
+		b.openUntil = time.Now().Add(MirrorCooldown)
+		log.Warnf("mirror: '%s' failed: '%d' times, skipped for: '%v'", mirror, b.failures, MirrorCooldown)
+	}
+}
+
+// Request url of repository from its mirrors in order until one responds
+// without 5xx. Url of repository is replaced with url of mirror and each
+// mirror is requested once with its own credentials, retries would delay
+// failover. Repository without mirrors is requested directly.
+func (r PublicRepository) failover(url string, download func(m PublicRepository, url string) (*http.Response, error)) (*http.Response, error) {
+	if len(r.Mirrors) == 0 || !strings.HasPrefix(url, r.Url) {
+		return download(r, url)
+	}
+	path := strings.TrimPrefix(url, r.Url)
+	var resp *http.Response
+	err := fmt.Errorf("%w: '%s'", MirrorsUnavailable, r.Name)
+	primary := r
+	primary.Mirrors = nil
+	for _, m := range append([]PublicRepository{primary}, r.Mirrors...) {
+		if !mirrorAvailable(m.Url, time.Now()) {
+			log.Debugf("mirror: '%s' skipped, circuit open", m.Url)
+			continue
+		}
+		if resp != nil {
+			if err := resp.Body.Close(); err != nil {
+				return nil, err
+			}
+		}
+		m.Client.RetryMax = -1
+		resp, err = download(m, m.Url+path)
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		mirrorResult(m.Url, failed)
+		if !failed {
+			return resp, nil
+		}
+		if err != nil {
+			log.Warnf("mirror: '%s' of: '%s' failed. Error: '%v'", m.Url, r.Name, err)
+		} else {
+			log.Warnf("mirror: '%s' of: '%s' returned: '%d'", m.Url, r.Name, resp.StatusCode)
+		}
+	}
+	// Response of last mirror with 5xx is returned to caller
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,114 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NotFoundUpstream is error of artifact that upstream responded 404 for
+var NotFoundUpstream = errors.New("artifact not found in upstream")
+
+// Remembered entries are pruned when there are more of them, entries that
+// expire first are evicted if all are valid
+var maxNotFound = 10000
+
+// Upstream 404 responses remembered until expiry, key is path of file in cache
+var (
+	notFoundMutex sync.Mutex
+	notFound      = map[string]time.Time{}
+)
+
+// RememberNotFound keep 404 of upstream for file of artefact during ttl,
+// fetch of file fails without request to upstream until then
+func RememberNotFound(a Artefact, ttl time.Duration) error {
+	if ttl > 0 {
+		notFoundMutex.Lock()
+		now := time.Now()
+		if _, ok := notFound[a.Path]; !ok && len(notFound) >= maxNotFound {
+			pruneNotFound(now)
+		}
+		notFound[a.Path] = now.Add(ttl)
+		notFoundMutex.Unlock()
+		log.Debugf("upstream: '%s' not found, remembered for: '%v'", a.Url, ttl)
+	}
+	return fmt.Errorf("%w: '%s'", NotFoundUpstream, a.Url)
+}
+
+// Remove expired entries and entries that expire first until map is below
+// cap, tenth of cap is freed so eviction does not run on every insert.
+// notFoundMutex is held by caller.
+func pruneNotFound(now time.Time) {
+	for f, expires := range notFound {
+		if now.After(expires) {
+			delete(notFound, f)
+		}
+	}
+	if len(notFound) < maxNotFound {
+		return
+	}
+	files := make([]string, 0, len(notFound))
+	for f := range notFound {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return notFound[files[i]].Before(notFound[files[j]]) })
+	evict := len(notFound) - maxNotFound + maxNotFound/10 + 1
+	if evict > len(files) {
+		evict = len(files)
+	}
+	for _, f := range files[:evict] {
+		delete(notFound, f)
+	}
+	log.Debugf("evicted: '%d' remembered upstream 404, cap: '%d' reached", evict, maxNotFound)
+}
+
+// NotFound report that upstream responded 404 for file f, expired entry is
+// forgotten
+func NotFound(f string) bool {
+	notFoundMutex.Lock()
+	defer notFoundMutex.Unlock()
+	expires, ok := notFound[f]
+	if ok && time.Now().After(expires) {
+		delete(notFound, f)
+		return false
+	}
+	return ok
+}
+
+// NotFoundEntries return remembered files with expiry
+func NotFoundEntries() map[string]time.Time {
+	notFoundMutex.Lock()
+	defer notFoundMutex.Unlock()
+	entries := map[string]time.Time{}
+	now := time.Now()
+	for f, expires := range notFound {
+		if now.After(expires) {
+			delete(notFound, f)
+			continue
+		}
+		entries[f] = expires
+	}
+	return entries
+}
+
+// FlushNotFound forget remembered files in dir or file dir itself, return
+// number of entries removed
+func FlushNotFound(dir string) int {
+	notFoundMutex.Lock()
+	defer notFoundMutex.Unlock()
+	n := 0
+	for f := range notFound {
+		if f == dir || strings.HasPrefix(f, dir+string(filepath.Separator)) {
+			delete(notFound, f)
+			n++
+		}
+	}
+	log.Infof("flushed: '%d' remembered upstream 404 of: '%s'", n, dir)
+	return n
+}
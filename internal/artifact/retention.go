@@ -0,0 +1,71 @@
+package artifact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+)
+
+// Deleted version of artifact or build of SNAPSHOT reported by cleanup
+type Deleted struct {
+	Repo     string `json:"repo"`
+	Artifact string `json:"artifact"`
+	Version  string `json:"version"`
+	Reason   string `json:"reason"`
+}
+
+// Version of artifact with time of publish
+type Version struct {
+	Name       string
+	Published  time.Time
+	Prerelease bool
+}
+
+// Expired return versions deleted by retention rules with reason, versions
+// must be sorted from oldest to newest
+func Expired(rules []project.Retention, versions []Version, now time.Time) (map[string]string, error) {
+	expired := map[string]string{}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("retention pattern: '%s' is not valid. Error: '%v'", rule.Pattern, err)
+		}
+		matched := []Version{}
+		for _, v := range versions {
+			if _, ok := expired[v.Name]; !ok && re.MatchString(v.Name) {
+				matched = append(matched, v)
+			}
+		}
+		if rule.PrereleaseDays > 0 {
+			maxAge := time.Duration(rule.PrereleaseDays) * 24 * time.Hour
+			kept := matched[:0]
+			for _, v := range matched {
+				if v.Prerelease && !v.Published.IsZero() && now.Sub(v.Published) > maxAge {
+					expired[v.Name] = fmt.Sprintf("prerelease older than: '%d' days", rule.PrereleaseDays)
+					continue
+				}
+				kept = append(kept, v)
+			}
+			matched = kept
+		}
+		if rule.KeepLast > 0 && len(matched) > rule.KeepLast {
+			for _, v := range matched[:len(matched)-rule.KeepLast] {
+				expired[v.Name] = fmt.Sprintf("not in last: '%d' versions", rule.KeepLast)
+			}
+		}
+	}
+	return expired, nil
+}
+
+// SortedKeys return names of expired versions in order
+func SortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
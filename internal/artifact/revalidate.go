@@ -0,0 +1,42 @@
+package artifact
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/file"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Revalidate checks cached file with upstream when it was checked more than
+// maxAge ago. Returns upstream response with new content or nil when cached
+// file can be served: still fresh, not modified or upstream unreachable.
+func Revalidate(a Artefact, maxAge time.Duration, repo PublicRepository) (*http.Response, error) {
+	s := file.ReadState(a.Path)
+	if s.Fresh(maxAge) {
+		log.Tracef("file: '%s' is fresh, checked: '%v'", a.Path, s.Checked)
+		return nil, nil
+	}
+	resp, err := repo.failover(a.Url, func(m PublicRepository, url string) (*http.Response, error) {
+		return file.DownloadIfModified(url, s, m.Client, m.Header())
+	})
+	if err != nil {
+		log.Warnf("upstream unreachable, cached file: '%s' served. Error: '%v'", a.Path, err)
+		return nil, nil
+	}
+	if resp.StatusCode == http.StatusOK {
+		log.Debugf("file: '%s' modified in upstream: '%s'", a.Path, a.Url)
+		return resp, nil
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		log.Warnf("upstream: '%s' returned: '%d', cached file: '%s' served", a.Url, resp.StatusCode, a.Path)
+		return nil, nil
+	}
+	log.Tracef("file: '%s' not modified in upstream", a.Path)
+	s.Checked = time.Now()
+	return nil, file.WriteState(a.Path, s)
+}
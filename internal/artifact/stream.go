@@ -0,0 +1,79 @@
+package artifact
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/morhayn/yaam2/internal/file"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Response track that response was sent to client already, artifact streamed
+// from upstream is not read from disk again
+type Response struct {
+	http.ResponseWriter
+	Sent bool
+}
+
+func (r *Response) WriteHeader(code int) {
+	r.Sent = true
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *Response) Write(b []byte) (int, error) {
+	r.Sent = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Sent report that response was sent to client by Preserve
+func Sent(w http.ResponseWriter) bool {
+	r, ok := w.(*Response)
+	return ok && r.Sent
+}
+
+// Streamable report that upstream body can be sent to client while caching:
+// full GET of client that checks Sent
+func Streamable(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := w.(*Response)
+	return ok && r != nil && r.Method == http.MethodGet && r.Header.Get("Range") == ""
+}
+
+// Client writer keeps caching when client is gone
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(b []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// Stream send upstream body to client and to temporary file near f at the same
+// time. File is committed to f only if transfer is complete and verify accepts
+// it, otherwise it is dropped. Content-Length is not sent, so client does not
+// get complete response if Stream fails after response was started.
+func Stream(w http.ResponseWriter, resp *http.Response, f string, verify func(tmp string) error) error {
+	w.Header().Set("Content-Type", contentType(f))
+	w.WriteHeader(http.StatusOK)
+	client := &clientWriter{w: w}
+	complete := func(tmp string) error {
+		if size, _ := file.Exists(tmp); resp.ContentLength >= 0 && size != resp.ContentLength {
+			return fmt.Errorf("download of: '%s' failed. Size: '%d' does not match Content-Length: '%d'", f, size, resp.ContentLength)
+		}
+		return nil
+	}
+	written, err := file.WriteAtomic(f, io.TeeReader(resp.Body, client), complete, verify)
+	if err != nil {
+		return err
+	}
+	if client.err != nil {
+		log.Warnf("client of: '%s' is gone, file cached. Error: '%v'", f, client.err)
+	}
+	log.Debugf("streamed: '%s' to client and disk. Wrote: '%d' bytes", f, written)
+	return nil
+}
@@ -0,0 +1,16 @@
+package eviction
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Access time of file, modification time if it is not known
+func accessTime(fi fs.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
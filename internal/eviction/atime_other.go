@@ -0,0 +1,14 @@
+//go:build !linux
+
+package eviction
+
+import (
+	"io/fs"
+	"time"
+)
+
+// Access time of file is not read on this platform, artifacts are evicted in
+// order of modification
+func accessTime(fi fs.FileInfo) time.Time {
+	return fi.ModTime()
+}
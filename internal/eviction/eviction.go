@@ -0,0 +1,254 @@
+package eviction
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Access time is updated at most once per touchInterval, reads of popular
+// artifacts do not write to disk every time
+const touchInterval = time.Hour
+
+// Cached file of proxy repository
+type entry struct {
+	path     string
+	repo     string
+	size     int64
+	accessed time.Time
+}
+
+// Removed artifact of last eviction
+type Removed struct {
+	Path     string    `json:"path"`
+	Repo     string    `json:"repo"`
+	Size     int64     `json:"size"`
+	Accessed time.Time `json:"accessed"`
+}
+
+// Result of eviction, sizes in bytes
+type Result struct {
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size"`
+	Freed   int64     `json:"freed"`
+	Removed []Removed `json:"removed"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	runMutex  sync.Mutex
+	lastMutex sync.Mutex
+	last      Result
+)
+
+// Touch update access time of file read from cache, modification time is
+// kept as it is Last-Modified of artifact
+func Touch(f string) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(accessTime(fi)) < touchInterval {
+		return
+	}
+	if err := os.Chtimes(f, now, fi.ModTime()); err != nil {
+		log.Warnf("access time of: '%s' not updated. Error: '%v'", f, err)
+	}
+}
+
+// Last return result of last eviction
+func Last() Result {
+	lastMutex.Lock()
+	defer lastMutex.Unlock()
+	return last
+}
+
+// Start run eviction in background every interval of config file
+func Start() {
+	go func() {
+		for {
+			if _, err := Run(); err != nil {
+				log.Errorf("eviction failed. Error: '%v'", err)
+			}
+			time.Sleep(project.Conf.Interval())
+		}
+	}()
+}
+
+// Split path in cache to {pack}/{repo}, files of hosted repositories are not
+// evictable
+func repoOf(h, f string) (string, bool) {
+	rel, err := filepath.Rel(h, f)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+	if len(parts) < 3 {
+		return "", false
+	}
+	return parts[0] + "/" + parts[1], !project.Conf.IsHosted(parts[0], parts[1])
+}
+
+// Size limit of repository {pack}/{repo}
+func maxSize(repo string) int64 {
+	pack, name, _ := strings.Cut(repo, "/")
+	return int64(project.Conf.GetRepos(pack)[name].MaxSize)
+}
+
+// Hidden files near artifact: dir/.name.state of cache and dir/.name.control
+// with Packages stanza of apt package
+var sidecarSuffixes = []string{".state", ".control"}
+
+func isSidecar(name string) bool {
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, s := range sidecarSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Files of cache: evictable artifacts of proxy repositories and size of all
+// files, temporary and sidecar files are not artifacts
+func scan(h string) ([]entry, int64, error) {
+	entries := []entry{}
+	var total int64
+	err := filepath.WalkDir(h, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		total += fi.Size()
+		name := d.Name()
+		if strings.HasSuffix(name, ".part") || isSidecar(name) {
+			return nil
+		}
+		repo, evictable := repoOf(h, p)
+		if !evictable {
+			return nil
+		}
+		entries = append(entries, entry{path: p, repo: repo, size: fi.Size(), accessed: accessTime(fi)})
+		return nil
+	})
+	return entries, total, err
+}
+
+// Run evict least recently used artifacts of proxy repositories exceeding
+// maxsize of repository, then of all repositories while cache exceeds
+// maxcachesize. Artifacts are removed with their sidecars from cache directory
+// and storage backend, otherwise they would be restored on next request.
+func Run() (Result, error) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	result := Result{Started: time.Now(), Removed: []Removed{}}
+	err := run(&result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	lastMutex.Lock()
+	last = result
+	lastMutex.Unlock()
+	return result, err
+}
+
+// Limits configured, cache is not scanned without them
+func limited() bool {
+	if project.Conf.MaxCacheSize > 0 {
+		return true
+	}
+	for _, pack := range []string{"apt", "npm", "maven"} {
+		for _, r := range project.Conf.GetRepos(pack) {
+			if r.MaxSize > 0 && !r.Hosted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func run(result *Result) error {
+	if !limited() {
+		return nil
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return err
+	}
+	entries, total, err := scan(h)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessed.Before(entries[j].accessed) })
+	repoSize := map[string]int64{}
+	for _, e := range entries {
+		repoSize[e.repo] += e.size
+	}
+
+	evicted := make([]bool, len(entries))
+	evict := func(i int) {
+		e := entries[i]
+		if err := storage.Remove(e.path); err != nil {
+			log.Errorf("file: '%s' not evicted. Error: '%v'", e.path, err)
+			return
+		}
+		for _, s := range sidecarSuffixes {
+			sidecar := filepath.Join(filepath.Dir(e.path), "."+filepath.Base(e.path)+s)
+			if err := storage.Remove(sidecar); err != nil {
+				log.Warnf("file: '%s' of: '%s' not removed. Error: '%v'", sidecar, e.path, err)
+			}
+		}
+		evicted[i] = true
+		repoSize[e.repo] -= e.size
+		total -= e.size
+		result.Freed += e.size
+		result.Removed = append(result.Removed, Removed{Path: e.path, Repo: e.repo, Size: e.size, Accessed: e.accessed})
+		log.Debugf("file: '%s' evicted, last access: '%s'", e.path, e.accessed.Format(time.RFC3339))
+	}
+	for i, e := range entries {
+		if max := maxSize(e.repo); max > 0 && repoSize[e.repo] > max {
+			evict(i)
+		}
+	}
+	if max := int64(project.Conf.MaxCacheSize); max > 0 {
+		for i := range entries {
+			if total <= max {
+				break
+			}
+			if !evicted[i] {
+				evict(i)
+			}
+		}
+	}
+	result.Size = total
+	if len(result.Removed) > 0 {
+		log.Infof("eviction removed: '%d' artifacts, freed: '%s', cache size: '%s'", len(result.Removed), project.Size(result.Freed), project.Size(total))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package eviction
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+)
+
+func cached(t *testing.T, h, p string, size int, accessed time.Time) string {
+	f := filepath.Join(h, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(f), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f, []byte(strings.Repeat("a", size)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(f, accessed, accessed); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRun(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		CacheDir:     t.TempDir(),
+		MaxCacheSize: 25,
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central":  {Url: "https://repo.maven.apache.org/maven2/", MaxSize: 10},
+				"releases": {Hosted: true},
+			},
+			Npm: map[string]project.Repos{
+				"npmjs": {Url: "https://registry.npmjs.org/"},
+			},
+		},
+	}
+	h, _ := project.RepositoriesHome()
+	now := time.Now()
+	cached(t, h, "maven/central/a/1/a-1.jar", 5, now.Add(-4*time.Hour))
+	cached(t, h, "maven/central/a/2/a-2.jar", 5, now.Add(-3*time.Hour))
+	cached(t, h, "maven/central/a/3/a-3.jar", 5, now.Add(-time.Minute))
+	cached(t, h, "maven/releases/b/1/b-1.jar", 10, now.Add(-48*time.Hour))
+	cached(t, h, "npm/npmjs/c/-/c-1.tgz", 5, now.Add(-2*time.Hour))
+	cached(t, h, "npm/npmjs/d/-/d-1.tgz", 5, now.Add(-90*time.Minute))
+	cached(t, h, "npm/npmjs/d/-/.d-1.tgz.1.part", 1, now.Add(-96*time.Hour))
+
+	result, err := Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := []string{}
+	for _, r := range result.Removed {
+		rel, _ := filepath.Rel(h, r.Path)
+		removed = append(removed, filepath.ToSlash(rel))
+	}
+	sort.Strings(removed)
+	// central exceeds maxsize, then oldest artifact of proxy repositories
+	// while cache exceeds maxcachesize, hosted and temporary files are kept
+	expected := "maven/central/a/1/a-1.jar,maven/central/a/2/a-2.jar,npm/npmjs/c/-/c-1.tgz"
+	if strings.Join(removed, ",") != expected {
+		t.Fatalf("removed: '%v', expected: '%s'", removed, expected)
+	}
+	if result.Freed != 15 || result.Size != 36-15 {
+		t.Fatalf("freed: '%d' size: '%d' not expected", result.Freed, result.Size)
+	}
+	if _, err := os.Stat(filepath.Join(h, "maven/releases/b/1/b-1.jar")); err != nil {
+		t.Fatal(err)
+	}
+	if len(Last().Removed) != 3 {
+		t.Fatal("result of last eviction not kept")
+	}
+
+	t.Run("backend and sidecars", func(t *testing.T) {
+		backend := t.TempDir()
+		storage.Backend = storage.Local{Dir: backend}
+		defer func() { storage.Backend = nil }()
+		project.Conf.MaxCacheSize = 0
+		f := cached(t, h, "maven/central/e/1/e-1.jar", 20, now.Add(-time.Hour))
+		sidecars := []string{
+			cached(t, h, "maven/central/e/1/.e-1.jar.state", 1, now),
+			cached(t, h, "maven/central/e/1/.e-1.jar.control", 1, now),
+		}
+		for _, c := range append(sidecars, f) {
+			if err := storage.Upload(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := Run(); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range append(sidecars, f) {
+			if _, err := os.Stat(c); !os.IsNotExist(err) {
+				t.Fatalf("file: '%s' not evicted from cache", c)
+			}
+			rel, _ := filepath.Rel(h, c)
+			if _, err := os.Stat(filepath.Join(backend, rel)); !os.IsNotExist(err) {
+				t.Fatalf("file: '%s' not evicted from backend", c)
+			}
+		}
+		// Evicted artifact is not restored from backend
+		if ok, err := storage.Restore(f); err != nil || ok {
+			t.Fatalf("file: '%s' restored", f)
+		}
+	})
+
+	t.Run("touch", func(t *testing.T) {
+		f := filepath.Join(h, "npm/npmjs/d/-/d-1.tgz")
+		Touch(f)
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(accessTime(fi)) > time.Minute || time.Since(fi.ModTime()) < time.Hour {
+			t.Fatalf("access time: '%v' modification time: '%v' not expected", accessTime(fi), fi.ModTime())
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package file
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/morhayn/yaam2/internal/project"
+)
+
+// Direct disables proxy of upstream set in environment
+const Direct = "direct"
+
+var (
+	clientsMutex sync.Mutex
+	clients      = map[project.HttpClient]*retryablehttp.Client{}
+)
+
+// Client return pooled client of upstream configuration, created on first use
+// and shared by upstreams with same configuration
+func Client(c project.HttpClient) (*retryablehttp.Client, error) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if client, ok := clients[c]; ok {
+		return client, nil
+	}
+	transport, err := newTransport(c)
+	if err != nil {
+		return nil, err
+	}
+	client := retryablehttp.NewClient()
+	client.Logger = nil
+	client.HTTPClient = &http.Client{Transport: transport, Timeout: c.Timeout}
+	client.RetryMax = c.Retries()
+	client.RetryWaitMin, client.RetryWaitMax = c.Backoff()
+	clients[c] = client
+	return client, nil
+}
+
+// Transport with proxy, TLS and timeouts of upstream configuration
+func newTransport(c project.HttpClient) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   c.Connect(),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = c.Connect()
+	transport.ResponseHeaderTimeout = c.ResponseTimeout
+
+	switch c.Proxy {
+	case "":
+		transport.Proxy = http.ProxyFromEnvironment
+	case Direct:
+		transport.Proxy = nil
+	default:
+		u, err := url.Parse(c.Proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("proxy: '%s' is not valid url", c.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// TLS of upstream trusts system and configured CAs
+func newTLSConfig(c project.HttpClient) (*tls.Config, error) {
+	/* #nosec */
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(filepath.Clean(c.CACert))
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("cacert: '%s' contains no PEM certificate", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: '%s' not loaded. Error: '%v'", c.ClientCert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
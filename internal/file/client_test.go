@@ -0,0 +1,107 @@
+package file
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+)
+
+func body(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestClient(t *testing.T) {
+	t.Run("pooled", func(t *testing.T) {
+		c := project.HttpClient{RetryMax: 3}
+		a, err := Client(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Client(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != b || a.RetryMax != 3 || a.RetryWaitMin != project.DefaultRetryWaitMin {
+			t.Fatal("client of same configuration not shared or not configured")
+		}
+	})
+	t.Run("retries", func(t *testing.T) {
+		var hits int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&hits, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		}))
+		defer ts.Close()
+		c := project.HttpClient{RetryMax: 2, RetryWaitMin: time.Millisecond, RetryWaitMax: time.Millisecond}
+		resp, err := DownloadWithRetries(ts.URL, c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body(t, resp) != "ok" || atomic.LoadInt32(&hits) != 3 {
+			t.Fatalf("hits: '%d' not expected", hits)
+		}
+		atomic.StoreInt32(&hits, 0)
+		c.RetryMax = -1
+		if _, err := DownloadWithRetries(ts.URL, c, nil); err == nil || atomic.LoadInt32(&hits) != 1 {
+			t.Fatalf("retried with retries disabled, hits: '%d'", hits)
+		}
+	})
+	t.Run("proxy", func(t *testing.T) {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("proxied " + r.URL.String()))
+		}))
+		defer proxy.Close()
+		resp, err := DownloadWithRetries("http://registry.example.invalid/lodash", project.HttpClient{Proxy: proxy.URL}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := body(t, resp); b != "proxied http://registry.example.invalid/lodash" {
+			t.Fatalf("request not sent through proxy: '%s'", b)
+		}
+		if _, err := Client(project.HttpClient{Proxy: "not a url"}); err == nil {
+			t.Fatal("invalid proxy accepted")
+		}
+	})
+	t.Run("tls", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}))
+		defer ts.Close()
+		if _, err := DownloadWithRetries(ts.URL, project.HttpClient{RetryMax: -1}, nil); err == nil {
+			t.Fatal("untrusted certificate accepted")
+		}
+		ca := filepath.Join(t.TempDir(), "ca.pem")
+		b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+		if err := os.WriteFile(ca, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []project.HttpClient{{CACert: ca}, {InsecureSkipVerify: true}} {
+			resp, err := DownloadWithRetries(ts.URL, c, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body(t, resp) != "ok" {
+				t.Fatal("body not expected")
+			}
+		}
+		if _, err := Client(project.HttpClient{CACert: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+			t.Fatal("missing cacert accepted")
+		}
+	})
+}
@@ -1,6 +1,9 @@
 package file
 
 import (
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
@@ -8,6 +11,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/morhayn/yaam2/internal/project"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,29 +28,71 @@ const (
 	WaitMsg          = "wait: '%v' before retrying"
 )
 
-func DownloadWithRetries(url string, auth ...string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+var CheckSumNotValid = errors.New("checksum not match")
+
+// Digest calculate hash of file in hex
+func Digest(f string, h hash.Hash) (string, error) {
+	src, err := os.Open(filepath.Clean(f))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	if len(auth) > 0 {
-		req.SetBasicAuth(auth[0], auth[1])
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if _, err := io.Copy(h, src); err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
 
-	retryClient := retryablehttp.NewClient()
-	retryClient.Logger = nil
-	retryClient.RetryMax = 5
-	retryClient.RetryWaitMin = 10 * time.Second
-	retryClient.RetryWaitMax = 60 * time.Second
-	standardClient := retryClient.StandardClient()
+// DownloadWithRetries send GET to upstream with client of its configuration,
+// failed request is retried with backoff
+func DownloadWithRetries(url string, c project.HttpClient, header http.Header) (*http.Response, error) {
+	req, err := retryablehttp.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeader(req.Request, header)
+	client, err := Client(c)
+	if err != nil {
+		return nil, err
+	}
 
 	/* #nosec */
-	resp, err := standardClient.Do(req)
+	return client.Do(req)
+}
+
+// DownloadIfModified send conditional GET with validators of cached file,
+// upstream response 304 Not Modified if cached file is valid. No retries,
+// cached file is served if upstream unreachable.
+func DownloadIfModified(url string, s State, c project.HttpClient, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	setHeader(req, header)
+	if s.ETag != "" {
+		req.Header.Set("If-None-Match", s.ETag)
+	}
+	if s.LastModified != "" {
+		req.Header.Set("If-Modified-Since", s.LastModified)
+	}
+	client, err := Client(c)
+	if err != nil {
+		return nil, err
+	}
+
+	/* #nosec */
+	return client.HTTPClient.Do(req)
+}
 
-	return resp, nil
+// Headers of upstream, e.g. authorization, are set on request
+func setHeader(req *http.Request, header http.Header) {
+	for k, v := range header {
+		req.Header[k] = v
+	}
 }
 
 func Exists(f string) (int64, bool) {
@@ -58,27 +104,17 @@ func Exists(f string) (int64, bool) {
 	return fi.Size(), true
 }
 
-func CreateIfDoesNotExistInvalidOrEmpty(url, f string, body io.ReadCloser, invalid bool) error {
+// Write downloaded body to f if it does not exist, is empty or invalid. File
+// is replaced atomically after validate functions accept it.
+func CreateIfDoesNotExistInvalidOrEmpty(url, f string, body io.ReadCloser, invalid bool, validate ...func(tmp string) error) error {
 	var written int64
 	fileSize, fileExists := Exists(f)
 	if !fileExists || fileSize == 0 || invalid {
-		dst, err := os.Create(filepath.Clean(f))
+		var err error
+		written, err = WriteAtomic(f, body, validate...)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := dst.Close(); err != nil {
-				panic(err)
-			}
-		}()
-
-		written, err = io.Copy(dst, body)
-		if err != nil {
-			return err
-		}
-		if err := dst.Sync(); err != nil {
-			return err
-		}
 	}
 	log.Debugf("downloaded: '%s' to: '%s'. Wrote: '%d' bytes", url, f, written)
 
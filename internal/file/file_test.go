@@ -1,8 +1,16 @@
 package file
 
 import (
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
 )
 
 func TestEmptyFile(t *testing.T) {
@@ -39,3 +47,81 @@ func TestExists(t *testing.T) {
 func TestCreateIfDoesNotExistInvalidOrEmpty(t *testing.T) {
 
 }
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "lib-1.0.jar")
+	if err := os.WriteFile(f, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("not valid", func(t *testing.T) {
+		_, err := WriteAtomic(f, strings.NewReader("new"), func(tmp string) error { return CheckSumNotValid })
+		if !errors.Is(err, CheckSumNotValid) {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(f); string(b) != "old" {
+			t.Fatal("file replaced by not valid file ", string(b))
+		}
+	})
+	t.Run("broken body", func(t *testing.T) {
+		if _, err := WriteAtomic(f, iotest.ErrReader(io.ErrUnexpectedEOF)); err == nil {
+			t.Fatal("broken body written")
+		}
+	})
+	t.Run("valid", func(t *testing.T) {
+		if _, err := WriteAtomic(f, strings.NewReader("new")); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := os.ReadFile(f); string(b) != "new" {
+			t.Fatal("file not replaced ", string(b))
+		}
+		// Temporary file is created with 0600
+		if fi, err := os.Stat(f); err != nil || fi.Mode().Perm() != 0o644 {
+			t.Fatal("wrong mode of file ", fi.Mode(), err)
+		}
+	})
+	if parts, _ := filepath.Glob(filepath.Join(dir, ".*")); len(parts) > 0 {
+		t.Fatal("temporary files left ", parts)
+	}
+	t.Run("remove temp", func(t *testing.T) {
+		tmp, err := CreateTemp(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp.Close()
+		if err := RemoveTemp(dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, fileExists := Exists(tmp.Name()); fileExists {
+			t.Fatal("temporary file not removed")
+		}
+		if _, fileExists := Exists(f); !fileExists {
+			t.Fatal("file removed")
+		}
+	})
+}
+
+// Backend failing every write
+type failingBackend struct {
+	storage.Local
+}
+
+func (failingBackend) Put(key string, r io.Reader, size int64) error {
+	return errors.New("backend unavailable")
+}
+
+func TestWriteAtomicUploadFailed(t *testing.T) {
+	project.Conf = project.ConfigFile{CacheDir: t.TempDir()}
+	storage.Backend = failingBackend{storage.Local{Dir: t.TempDir()}}
+	defer func() { storage.Backend = nil }()
+	h, _ := project.RepositoriesHome()
+	f := filepath.Join(h, "maven/releases/lib-1.0.jar")
+	if err := os.MkdirAll(filepath.Dir(f), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteAtomic(f, strings.NewReader("jar")); err == nil {
+		t.Fatal("upload error not returned")
+	}
+	if _, fileExists := Exists(f); fileExists {
+		t.Fatal("file not stored in backend cached")
+	}
+}
@@ -0,0 +1,62 @@
+package file
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/storage"
+)
+
+// State of cached file for revalidation with upstream
+type State struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Checked      time.Time `json:"checked"`
+	// Verified checksum of cached file
+	Digest string `json:"digest,omitempty"`
+}
+
+// Hidden file near cached file: dir/.name.state
+func statePath(f string) string {
+	return filepath.Join(filepath.Dir(f), "."+filepath.Base(f)+".state")
+}
+
+// NewState create state checked now with validators from upstream response
+func NewState(h http.Header) State {
+	return State{ETag: h.Get("ETag"), LastModified: h.Get("Last-Modified"), Checked: time.Now()}
+}
+
+// ReadState return state of cached file, zero state if file never checked
+func ReadState(f string) State {
+	s := State{}
+	b, err := os.ReadFile(filepath.Clean(statePath(f)))
+	if err != nil {
+		return s
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return State{}
+	}
+	return s
+}
+
+// WriteState save state of cached file
+func WriteState(f string, s State) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return WriteFile(statePath(f), b)
+}
+
+// RemoveState remove state of cached file
+func RemoveState(f string) error {
+	return storage.Remove(statePath(f))
+}
+
+// Fresh report that file was checked with upstream less than maxAge ago
+func (s State) Fresh(maxAge time.Duration) bool {
+	return time.Since(s.Checked) < maxAge
+}
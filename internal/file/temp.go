@@ -0,0 +1,62 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CreateTemp create hidden temporary file near f: dir/.name.*.part
+func CreateTemp(f string) (*os.File, error) {
+	return storage.CreateTemp(f)
+}
+
+// WriteAtomic write body to temporary file near f, fsync it and rename it to
+// f if all validate functions accept temporary file. Readers never see
+// partially written f, temporary file is removed on failure. File is stored
+// in storage backend before rename, file not stored is not cached either.
+func WriteAtomic(f string, body io.Reader, validate ...func(tmp string) error) (int64, error) {
+	// Write through to storage shared by replicas
+	upload := func(tmp string) error {
+		return storage.UploadAs(tmp, f)
+	}
+	return storage.WriteAtomic(f, body, append(append([]func(string) error{}, validate...), upload)...)
+}
+
+// WriteFile write data to f atomically
+func WriteFile(f string, data []byte) error {
+	_, err := WriteAtomic(f, bytes.NewReader(data))
+	return err
+}
+
+// RemoveTemp remove temporary files left in dir by writes interrupted by crash
+func RemoveTemp(dir string) error {
+	removed := 0
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !storage.IsTemp(p) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		log.Infof("removed: '%d' temporary files left in: '%s'", removed, dir)
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package maven
+
+import (
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/morhayn/yaam2/internal/project"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Upstream checksum sidecar files in order of preference
+var checksums = []struct {
+	ext  string
+	hash func() hash.Hash
+}{
+	{".sha256", sha256.New},
+	{".sha1", sha1.New},
+	{".md5", md5.New},
+}
+
+// Checksum files and metadata are not verified
+func skipChecksum(f string) bool {
+	return isSidecar(f) || filepath.Base(f) == metadataFile
+}
+
+// Sidecars are optional, they are requested once with short timeout and
+// without retries so that failing upstream does not delay artifact
+const sidecarTimeout = 10 * time.Second
+
+// Repository with client of sidecar requests
+func sidecarRepository(repo artifact.PublicRepository) artifact.PublicRepository {
+	once := func(c project.HttpClient) project.HttpClient {
+		c.RetryMax = -1
+		if c.Timeout <= 0 || c.Timeout > sidecarTimeout {
+			c.Timeout = sidecarTimeout
+		}
+		return c
+	}
+	repo.Client = once(repo.Client)
+	mirrors := make([]artifact.PublicRepository, 0, len(repo.Mirrors))
+	for _, m := range repo.Mirrors {
+		m.Client = once(m.Client)
+		mirrors = append(mirrors, m)
+	}
+	repo.Mirrors = mirrors
+	return repo
+}
+
+// Download checksum from sidecar file, empty if upstream has no sidecar
+func upstreamChecksum(url string, repo artifact.PublicRepository) (string, error) {
+	resp, err := repo.Download(url)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	// Sidecar may contain file name after checksum
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// Verify file f downloaded for artifact with first checksum sidecar found in
+// upstream, file with wrong checksum is removed from disk
+func verifyChecksum(a artifact.Artefact, f string, repo artifact.PublicRepository) error {
+	if skipChecksum(a.Path) {
+		return nil
+	}
+	repo = sidecarRepository(repo)
+	for _, c := range checksums {
+		expected, err := upstreamChecksum(a.Url+c.ext, repo)
+		if err != nil {
+			// Other sidecars of failing upstream are not requested
+			log.Warnf("checksum: '%s' not downloaded, file: '%s' not verified. Error: '%v'", a.Url+c.ext, a.Path, err)
+			return nil
+		}
+		if expected == "" {
+			continue
+		}
+		actual, err := file.Digest(f, c.hash())
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			log.Errorf("file: '%s' checksum on disk: '%s' does not match upstream checksum: '%s'", a.Path, actual, expected)
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: '%s' %s", file.CheckSumNotValid, a.Url, strings.TrimPrefix(c.ext, "."))
+		}
+		log.Tracef("file: '%s' %s checksum: '%s' is valid", a.Path, strings.TrimPrefix(c.ext, "."), actual)
+		return nil
+	}
+	log.Debugf("no checksum sidecar found for: '%s'", a.Url)
+	return nil
+}
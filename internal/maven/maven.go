@@ -1,38 +1,107 @@
 package maven
 
 import (
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/xml"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 
+	"github.com/morhayn/yaam2/internal/api"
 	"github.com/morhayn/yaam2/internal/artifact"
 	"github.com/morhayn/yaam2/internal/file"
 	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type Maven struct {
 	ResponseWriter http.ResponseWriter
+	Request        *http.Request
 	RequestBody    io.ReadCloser
 	RequestURI     string
 	Repo           string
 	Artifact       string
 }
 
-func (m Maven) downloadAgainIfInvalid(a artifact.Artefact, resp *http.Response) error {
-	log.Trace(resp.StatusCode)
-	fmt.Println(resp.StatusCode)
+// Metadata and SNAPSHOT change in upstream and are revalidated
+func isMetadata(f string) bool {
+	return strings.HasPrefix(filepath.Base(f), "maven-metadata.xml") || strings.Contains(filepath.ToSlash(f), "-SNAPSHOT/")
+}
+
+// Save downloaded artifact, verify checksum and keep validators of metadata
+func (m Maven) save(a artifact.Artefact, resp *http.Response, repo artifact.PublicRepository, invalid bool) error {
+	verify := func(tmp string) error {
+		return verifyChecksum(a, tmp, repo)
+	}
+	if err := file.CreateIfDoesNotExistInvalidOrEmpty(a.Url, a.Path, resp.Body, invalid, verify); err != nil {
+		return err
+	}
+	if isMetadata(a.Path) {
+		return file.WriteState(a.Path, file.NewState(resp.Header))
+	}
+	return nil
+}
+
+// Download again metadata modified in upstream
+func (m Maven) revalidate(a artifact.Artefact, repo artifact.PublicRepository) error {
+	resp, err := artifact.Revalidate(a, project.Conf.Caches.Maven[m.Repo].MaxAge(), repo)
+	if err != nil || resp == nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	return m.save(a, resp, repo, true)
+}
+
+// Send artifact to client while it is downloaded, artifact is cached only
+// if checksum is valid
+func (m Maven) stream(a artifact.Artefact, repo artifact.PublicRepository) error {
+	resp, err := repo.Download(a.Url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return artifact.RememberNotFound(a, project.Conf.Caches.Maven[m.Repo].NegativeTTL())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: '%s' not completed statusCode: '%d'", a.Url, resp.StatusCode)
+	}
+	return artifact.Stream(m.ResponseWriter, resp, a.Path, func(tmp string) error {
+		return verifyChecksum(a, tmp, repo)
+	})
+}
+
+func (m Maven) downloadAgainIfInvalid(a artifact.Artefact, resp *http.Response, repo artifact.PublicRepository) error {
+	log.Tracef("download: '%s' statusCode: '%d'", a.Url, resp.StatusCode)
+	if _, fileExists := file.Exists(a.Path); !fileExists && resp.StatusCode == http.StatusNotFound {
+		return artifact.RememberNotFound(a, project.Conf.Caches.Maven[m.Repo].NegativeTTL())
+	}
 	if resp.StatusCode == http.StatusOK {
-		if err := file.CreateIfDoesNotExistInvalidOrEmpty(a.Url, a.Path, resp.Body, false); err != nil {
-			fmt.Println("Save file", err)
+		if err := m.save(a, resp, repo, false); err != nil {
 			return err
 		}
 	}
 
 	if file.EmptyFile(a.Path) {
-		if err := m.Preserve(); err != nil {
+		if err := m.fetch(a, repo); err != nil {
 			return err
 		}
 	}
@@ -41,12 +110,15 @@ func (m Maven) downloadAgainIfInvalid(a artifact.Artefact, resp *http.Response)
 }
 
 func (m Maven) Preserve(urlStrings ...string) error {
-	fmt.Println("MAVEN", m)
 	urlString := m.RequestURI
 	if len(urlStrings) > 0 {
 		urlString = urlStrings[0]
 	}
 	log.Tracef("urlString: '%s'", urlString)
+	// Hosted repository has no upstream, artifacts are served from disk
+	if project.Conf.IsHosted("maven", m.Repo) {
+		return nil
+	}
 
 	repoInConfigFile, err := artifact.RepoInConfigFile(urlString, m.Repo, project.Conf.Caches.Maven)
 	if err != nil {
@@ -58,70 +130,195 @@ func (m Maven) Preserve(urlStrings ...string) error {
 		if err != nil {
 			return err
 		}
-		fmt.Println(a.Url, repoInConfigFile)
-		resp, err := file.DownloadWithRetries(a.Url, repoInConfigFile.User, repoInConfigFile.Pass)
-		if err != nil {
-			return err
-		}
-		fmt.Println("+++++", a.Url, resp.Header)
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				panic(err)
-			}
-		}()
+		// One fetch of artifact at a time, concurrent requests wait for it
+		return artifact.Fetch(a.Path, func() error { return m.fetch(a, repoInConfigFile) })
+	}
 
-		if err := m.downloadAgainIfInvalid(a, resp); err != nil {
-			return err
+	return nil
+}
+
+// Serve artifact from cache or download it from upstream
+func (m Maven) fetch(a artifact.Artefact, repo artifact.PublicRepository) error {
+	// Artifact cached already, metadata is revalidated after max age
+	if size, fileExists := file.Exists(a.Path); fileExists && size > 0 {
+		if isMetadata(a.Path) {
+			return m.revalidate(a, repo)
 		}
+		return nil
+	}
+	if !isMetadata(a.Path) && artifact.Streamable(m.ResponseWriter, m.Request) {
+		return m.stream(a, repo)
+	}
+	log.Tracef("downloading: '%s' from: '%s'", a.Url, repo.Name)
+	resp, err := repo.Download(a.Url)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
 
-	return nil
+	return m.downloadAgainIfInvalid(a, resp, repo)
 }
 
+// Publish store deployed file. Hosted repository maintains maven-metadata.xml
+// itself, metadata uploaded by client is ignored, sidecars are generated.
 func (m Maven) Publish() error {
+	hosted := project.Conf.IsHosted("maven", m.Repo)
+	if hosted && strings.HasPrefix(filepath.Base(m.Artifact), metadataFile) {
+		log.Debugf("metadata: '%s' uploaded by client ignored", m.RequestURI)
+		_, err := io.Copy(io.Discard, m.RequestBody)
+		return err
+	}
 	if err := artifact.StoreOnDisk(m.RequestURI, m.RequestBody); err != nil {
 		return err
 	}
-
-	return nil
+	if !hosted || isSidecar(m.Artifact) {
+		return nil
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return err
+	}
+	repoDir := filepath.Join(h, "maven", m.Repo)
+	if err := writeSidecars(filepath.Join(repoDir, filepath.FromSlash(m.Artifact)), false); err != nil {
+		return err
+	}
+	return storage.RetryOnConflict(func() error { return updateMetadata(repoDir, m.Artifact) })
 }
 
 func (m Maven) Read() error {
-	if err := artifact.ReadFromDisk(m.ResponseWriter, m.RequestURI); err != nil {
+	if err := artifact.ReadFromDisk(m.ResponseWriter, m.Request, m.RequestURI); err != nil {
 		return fmt.Errorf(file.CannotReadErrMsg, err)
 	}
 
 	return nil
 }
 
-// func (m Maven) Unify(name string) error {
-// repos, err := artifact.AllowedRepos(name)
-// if err != nil {
-// return err
-// }
-
-// log.Debugf("repos: '%v'", repos)
-// for _, repo := range repos {
-// log.Tracef("repo: '%s'", repo)
-// urlString := "/" + repo + "/" + m.RequestURI
-// log.Debugf("urlString: '%s'", urlString)
-
-// h, err := project.RepositoriesHome()
-// if err != nil {
-// return err
-// }
-
-// if err := m.Preserve(urlString); err != nil {
-// log.Errorf("maven artifact caching failed. Error: '%v'", err)
-// }
-
-// if _, fileExists := file.Exists(filepath.Join(h, urlString)); fileExists {
-// if err := artifact.ReadFromDisk(m.ResponseWriter, urlString); err != nil {
-// log.Warnf(file.CannotReadErrMsg, err)
-// }
-// return nil
-// }
-// }
-
-// return nil
-// }
+// Member repository request for group
+func (m Maven) member(repo string) Maven {
+	return Maven{
+		ResponseWriter: m.ResponseWriter,
+		Request:        m.Request,
+		RequestBody:    m.RequestBody,
+		RequestURI:     "/maven/" + repo + "/" + m.Artifact,
+		Repo:           repo,
+		Artifact:       m.Artifact,
+	}
+}
+
+// Checksums of merged metadata are calculated, members have checksums of
+// their own metadata
+var metadataChecksums = map[string]func() hash.Hash{
+	".sha1":   sha1.New,
+	".md5":    md5.New,
+	".sha256": sha256.New,
+	".sha512": sha512.New,
+}
+
+// Metadata or its checksum, signature of metadata is not merged
+func isMergedMetadata(f string) bool {
+	base := filepath.Base(f)
+	if _, ok := metadataChecksums[filepath.Ext(base)]; ok {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return base == metadataFile
+}
+
+// Serve maven-metadata.xml or its checksum merged from metadata of members
+func (m Maven) unifyMetadata(h, name string, members []string) error {
+	ext := filepath.Ext(m.Artifact)
+	checksum, isChecksum := metadataChecksums[ext]
+	md := m
+	if isChecksum {
+		md.Artifact = strings.TrimSuffix(m.Artifact, ext)
+	}
+	docs := []Metadata{}
+	for _, repo := range members {
+		mm := md.member(repo)
+		if err := mm.Preserve(); err != nil {
+			log.Warnf("maven metadata caching from member: '%s' failed. Error: '%v'", repo, err)
+			continue
+		}
+		f := filepath.Join(h, mm.RequestURI)
+		if ok, err := artifact.Restore(f); err != nil || !ok {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Clean(f))
+		if err != nil {
+			return err
+		}
+		doc := Metadata{}
+		if err := xml.Unmarshal(b, &doc); err != nil {
+			log.Warnf("maven metadata of member: '%s' not read. Error: '%v'", repo, err)
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("metadata: '%s' not found in members of group: '%s'", md.Artifact, name)
+	}
+	b, err := marshalMetadata(mergeMetadata(docs))
+	if err != nil {
+		return err
+	}
+	if isChecksum {
+		c := checksum()
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+		m.ResponseWriter.Header().Set("Content-Type", "text/plain")
+		_, err := fmt.Fprintf(m.ResponseWriter, "%x", c.Sum(nil))
+		return err
+	}
+	m.ResponseWriter.Header().Set("Content-Type", "application/xml")
+	_, err = m.ResponseWriter.Write(b)
+	return err
+}
+
+// Unify serves artifact from first member of group that has it. Members are
+// checked in priority order, cache of all members first and upstreams after.
+// Metadata of artifact is merged from all members.
+func (m Maven) Unify(name string) error {
+	g, ok := project.Conf.Groups.Maven[name]
+	if !ok {
+		return fmt.Errorf("group: '%s' not found in config file", name)
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return err
+	}
+	members := api.ReadableMembers(m.Request, "maven", g.Members)
+	log.Debugf("group: '%s', members: '%v'", name, members)
+	if isMergedMetadata(m.Artifact) {
+		return m.unifyMetadata(h, name, members)
+	}
+
+	// Metadata changes in upstream and is revalidated by member
+	for _, repo := range members {
+		mm := m.member(repo)
+		if _, fileExists := file.Exists(filepath.Join(h, mm.RequestURI)); fileExists && !isMetadata(m.Artifact) {
+			log.Tracef("artifact: '%s' found in cache of member: '%s'", m.Artifact, repo)
+			return mm.Read()
+		}
+	}
+	for _, repo := range members {
+		mm := m.member(repo)
+		err := mm.Preserve()
+		// Artifact streamed from member to client
+		if artifact.Sent(m.ResponseWriter) {
+			return err
+		}
+		if err != nil {
+			log.Warnf("maven artifact caching from member: '%s' failed. Error: '%v'", repo, err)
+			continue
+		}
+		if _, fileExists := file.Exists(filepath.Join(h, mm.RequestURI)); fileExists {
+			return mm.Read()
+		}
+	}
+
+	return fmt.Errorf("artifact: '%s' not found in members of group: '%s'", m.Artifact, name)
+}
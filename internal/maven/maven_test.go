@@ -0,0 +1,601 @@
+package maven
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	yaamartifact "github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+)
+
+func TestUnify(t *testing.T) {
+	hits := 0
+	central := httptest.NewServer(http.NotFoundHandler())
+	defer central.Close()
+	gradle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/org/test/test/1.0/test-1.0.pom" {
+			http.NotFound(w, r)
+			return
+		}
+		hits++
+		w.Write([]byte("<project/>"))
+	}))
+	defer gradle.Close()
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central": {Url: central.URL},
+				"gradle":  {Url: gradle.URL},
+			},
+		},
+		Groups: project.Groups{
+			Maven: map[string]project.Group{
+				"public": {Members: []string{"central", "gradle"}},
+			},
+		},
+	}
+	artifact := "org/test/test/1.0/test-1.0.pom"
+	for _, name := range []string{"from upstream", "from cache"} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			m := Maven{ResponseWriter: w, RequestURI: "/maven/public/" + artifact, Repo: "public", Artifact: artifact}
+			if err := m.Unify("public"); err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != "<project/>" {
+				t.Fatal("wrong artifact ", w.Body.String())
+			}
+		})
+	}
+	if hits != 1 {
+		t.Fatalf("cached artifact downloaded again, hits: '%d'", hits)
+	}
+	t.Run("not found", func(t *testing.T) {
+		m := Maven{ResponseWriter: httptest.NewRecorder(), Repo: "public", Artifact: "org/test/none/1.0/none-1.0.jar"}
+		if err := m.Unify("public"); err == nil {
+			t.Fatal("artifact found")
+		}
+	})
+	t.Run("not group", func(t *testing.T) {
+		m := Maven{ResponseWriter: httptest.NewRecorder(), Repo: "central", Artifact: artifact}
+		if err := m.Unify("central"); err == nil {
+			t.Fatal("group found")
+		}
+	})
+	t.Run("member not readable", func(t *testing.T) {
+		project.Conf.Caches.Maven["gradle"] = project.Repos{Url: gradle.URL, Acl: project.Acl{Read: []string{"alice"}}}
+		r := httptest.NewRequest("GET", "/maven/public/"+artifact, nil)
+		m := Maven{ResponseWriter: httptest.NewRecorder(), Request: r, Repo: "public", Artifact: artifact}
+		if err := m.Unify("public"); err == nil {
+			t.Fatal("artifact of member served to anonymous user")
+		}
+	})
+}
+
+func TestUnifyMetadata(t *testing.T) {
+	upstream := func(versions, latest, release, updated string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/org/test/test/maven-metadata.xml" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "<metadata><groupId>org.test</groupId><artifactId>test</artifactId><versioning><latest>%s</latest><release>%s</release><versions>%s</versions><lastUpdated>%s</lastUpdated></versioning></metadata>", latest, release, versions, updated)
+		}))
+	}
+	central := upstream("<version>1.0</version><version>1.1</version>", "1.1", "1.1", "20230101000000")
+	defer central.Close()
+	gradle := upstream("<version>1.0</version><version>2.0-SNAPSHOT</version><version>1.5</version>", "2.0-SNAPSHOT", "1.5", "20230202000000")
+	defer gradle.Close()
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central": {Url: central.URL},
+				"gradle":  {Url: gradle.URL},
+				"empty":   {Url: central.URL + "/none"},
+			},
+		},
+		Groups: project.Groups{
+			Maven: map[string]project.Group{
+				"public": {Members: []string{"central", "empty", "gradle"}},
+			},
+		},
+	}
+	unify := func(t *testing.T, artifact string) string {
+		w := httptest.NewRecorder()
+		m := Maven{ResponseWriter: w, RequestURI: "/maven/public/" + artifact, Repo: "public", Artifact: artifact}
+		if err := m.Unify("public"); err != nil {
+			t.Fatal(err)
+		}
+		return w.Body.String()
+	}
+	body := unify(t, "org/test/test/maven-metadata.xml")
+	md := Metadata{}
+	if err := xml.Unmarshal([]byte(body), &md); err != nil {
+		t.Fatal(err)
+	}
+	v := md.Versioning
+	if strings.Join(v.Versions, ",") != "1.0,1.1,1.5,2.0-SNAPSHOT" || v.Latest != "2.0-SNAPSHOT" || v.Release != "1.5" || v.LastUpdated != "20230202000000" || md.ArtifactId != "test" {
+		t.Fatal("wrong merged metadata ", body)
+	}
+	if sum := unify(t, "org/test/test/maven-metadata.xml.sha1"); sum != fmt.Sprintf("%x", sha1.Sum([]byte(body))) {
+		t.Fatalf("checksum: '%s' not of merged metadata", sum)
+	}
+	t.Run("not found", func(t *testing.T) {
+		m := Maven{ResponseWriter: httptest.NewRecorder(), Repo: "public", Artifact: "org/test/none/maven-metadata.xml"}
+		if err := m.Unify("public"); err == nil {
+			t.Fatal("metadata found")
+		}
+	})
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	jar := []byte("jar content")
+	files := map[string]string{
+		"/org/test/good/1.0/good-1.0.jar":        string(jar),
+		"/org/test/good/1.0/good-1.0.jar.sha1":   fmt.Sprintf("%x  good-1.0.jar", sha1.Sum(jar)),
+		"/org/test/bad/1.0/bad-1.0.jar":          "truncated",
+		"/org/test/bad/1.0/bad-1.0.jar.sha256":   fmt.Sprintf("%x", sha256.Sum256(jar)),
+		"/org/test/bad/1.0/bad-1.0.jar.sha1":     fmt.Sprintf("%x", sha1.Sum([]byte("truncated"))),
+		"/org/test/plain/1.0/plain-1.0.jar":      string(jar),
+		"/org/test/upper/1.0/upper-1.0.jar":      string(jar),
+		"/org/test/upper/1.0/upper-1.0.jar.sha1": strings.ToUpper(fmt.Sprintf("%x", sha1.Sum(jar))),
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(f))
+	}))
+	defer upstream.Close()
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central": {Url: upstream.URL},
+			},
+		},
+	}
+	h, _ := project.RepositoriesHome()
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{name: "good"},
+		{name: "bad", err: file.CheckSumNotValid},
+		{name: "plain"},
+		{name: "upper"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			artifact := fmt.Sprintf("org/test/%[1]s/1.0/%[1]s-1.0.jar", tt.name)
+			m := Maven{ResponseWriter: httptest.NewRecorder(), RequestURI: "/maven/central/" + artifact, Repo: "central", Artifact: artifact}
+			err := m.Preserve()
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("expected: '%v', got: '%v'", tt.err, err)
+			}
+			_, fileExists := file.Exists(filepath.Join(h, m.RequestURI))
+			if fileExists != (tt.err == nil) {
+				t.Fatalf("file exists: '%t'", fileExists)
+			}
+		})
+	}
+	project.Conf.CacheDir = t.TempDir()
+	h, _ = project.RepositoriesHome()
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{name: "good"},
+		{name: "bad", err: file.CheckSumNotValid},
+	} {
+		t.Run("stream "+tt.name, func(t *testing.T) {
+			artifact := fmt.Sprintf("org/test/%[1]s/1.0/%[1]s-1.0.jar", tt.name)
+			rec := httptest.NewRecorder()
+			w := &yaamartifact.Response{ResponseWriter: rec}
+			m := Maven{ResponseWriter: w, Request: httptest.NewRequest(http.MethodGet, "/maven/central/"+artifact, nil), RequestURI: "/maven/central/" + artifact, Repo: "central", Artifact: artifact}
+			err := m.Preserve()
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("expected: '%v', got: '%v'", tt.err, err)
+			}
+			if !yaamartifact.Sent(w) || rec.Body.String() != files["/"+artifact] {
+				t.Fatal("artifact not streamed ", rec.Body.String())
+			}
+			_, fileExists := file.Exists(filepath.Join(h, m.RequestURI))
+			if fileExists != (tt.err == nil) {
+				t.Fatalf("file exists: '%t'", fileExists)
+			}
+		})
+	}
+}
+
+func TestSidecarFailing(t *testing.T) {
+	sidecars := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/org/test/lib/1.0/lib-1.0.jar" {
+			w.Write([]byte("jar content"))
+			return
+		}
+		sidecars++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central": {Url: upstream.URL, Client: project.HttpClient{RetryMax: 3, RetryWaitMin: time.Second}},
+			},
+		},
+	}
+	artifact := "org/test/lib/1.0/lib-1.0.jar"
+	m := Maven{ResponseWriter: httptest.NewRecorder(), RequestURI: "/maven/central/" + artifact, Repo: "central", Artifact: artifact}
+	start := time.Now()
+	if err := m.Preserve(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); sidecars != 1 || d > time.Second {
+		t.Fatalf("sidecars requested: '%d' times in: '%v'", sidecars, d)
+	}
+}
+
+func TestRevalidateMetadata(t *testing.T) {
+	metadata, etag, downloads := "<metadata>1.0</metadata>", `"v1"`, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/org/test/test/maven-metadata.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(metadata))
+	}))
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central": {Url: upstream.URL, MetadataMaxAge: time.Nanosecond},
+				"fresh":   {Url: upstream.URL, MetadataMaxAge: time.Hour},
+			},
+		},
+		Groups: project.Groups{
+			Maven: map[string]project.Group{
+				"public": {Members: []string{"central"}},
+			},
+		},
+	}
+	read := func(t *testing.T, repo string) string {
+		artifact := "org/test/test/maven-metadata.xml"
+		w := httptest.NewRecorder()
+		m := Maven{ResponseWriter: w, RequestURI: "/maven/" + repo + "/" + artifact, Repo: repo, Artifact: artifact}
+		if err := m.Preserve(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Read(); err != nil {
+			t.Fatal(err)
+		}
+		return w.Body.String()
+	}
+	t.Run("download", func(t *testing.T) {
+		if body := read(t, "central"); body != metadata || downloads != 1 {
+			t.Fatalf("body: '%s', downloads: '%d'", body, downloads)
+		}
+		read(t, "fresh")
+	})
+	t.Run("not modified", func(t *testing.T) {
+		if body := read(t, "central"); body != metadata || downloads != 2 {
+			t.Fatalf("body: '%s', downloads: '%d'", body, downloads)
+		}
+	})
+	metadata, etag = "<metadata>1.0 1.1</metadata>", `"v2"`
+	t.Run("modified", func(t *testing.T) {
+		if body := read(t, "central"); body != metadata || downloads != 3 {
+			t.Fatalf("body: '%s', downloads: '%d'", body, downloads)
+		}
+	})
+	t.Run("fresh", func(t *testing.T) {
+		if body := read(t, "fresh"); body != "<metadata>1.0</metadata>" || downloads != 3 {
+			t.Fatalf("body: '%s', downloads: '%d'", body, downloads)
+		}
+	})
+	metadata, etag = "<metadata><versioning><versions><version>1.2</version></versions></versioning></metadata>", `"v3"`
+	t.Run("modified through group", func(t *testing.T) {
+		artifact := "org/test/test/maven-metadata.xml"
+		w := httptest.NewRecorder()
+		m := Maven{ResponseWriter: w, RequestURI: "/maven/public/" + artifact, Repo: "public", Artifact: artifact}
+		if err := m.Unify("public"); err != nil {
+			t.Fatal(err)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "<version>1.2</version>") || downloads != 4 {
+			t.Fatalf("body: '%s', downloads: '%d'", body, downloads)
+		}
+	})
+	upstream.Close()
+	t.Run("upstream unreachable", func(t *testing.T) {
+		if body := read(t, "central"); body != metadata {
+			t.Fatalf("cached metadata not served: '%s'", body)
+		}
+	})
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct{ a, b string }{
+		{"1.0", "1.1"},
+		{"1.9", "1.10"},
+		{"1.0-alpha-1", "1.0-beta-1"},
+		{"1.0-RC1", "1.0"},
+		{"1.0-SNAPSHOT", "1.0"},
+		{"1.0", "1.0.1"},
+		{"1.0-beta", "1.0.1"},
+		{"1.0-20230101.101010-1", "1.0-20230101.101010-2"},
+	} {
+		if compareVersions(tt.a, tt.b) >= 0 || compareVersions(tt.b, tt.a) <= 0 {
+			t.Fatalf("version: '%s' must be less than: '%s'", tt.a, tt.b)
+		}
+	}
+}
+
+func TestPublishHosted(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"releases": {Hosted: true},
+			},
+		},
+	}
+	deploy := func(t *testing.T, artifact, body string) {
+		m := Maven{RequestURI: "/maven/releases/" + artifact, Repo: "releases", Artifact: artifact, RequestBody: io.NopCloser(strings.NewReader(body))}
+		if err := m.Publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(t *testing.T, artifact string) Metadata {
+		w := httptest.NewRecorder()
+		m := Maven{ResponseWriter: w, RequestURI: "/maven/releases/" + artifact, Repo: "releases", Artifact: artifact}
+		if err := m.Preserve(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Read(); err != nil {
+			t.Fatal(err)
+		}
+		md := Metadata{}
+		if err := xml.Unmarshal(w.Body.Bytes(), &md); err != nil {
+			t.Fatal(err)
+		}
+		return md
+	}
+	for _, f := range []string{
+		"1.9/lib-1.9.pom",
+		"1.9/lib-1.9.jar",
+		"1.10/lib-1.10.pom",
+		"1.10/lib-1.10.jar",
+		"2.0-SNAPSHOT/lib-2.0-20230102.030405-1.pom",
+		"2.0-SNAPSHOT/lib-2.0-20230102.030405-1.jar",
+	} {
+		deploy(t, "com/acme/lib/"+f, "content")
+	}
+	deploy(t, "com/acme/lib/2.0-SNAPSHOT/lib-2.0-20230102.040000-2.jar", "jar2")
+	deploy(t, "com/acme/lib/2.0-SNAPSHOT/lib-2.0-20230102.040000-2-sources.jar", "sources")
+	deploy(t, "com/acme/lib/maven-metadata.xml", "<metadata>client</metadata>")
+	t.Run("artifact metadata", func(t *testing.T) {
+		md := read(t, "com/acme/lib/maven-metadata.xml")
+		v := md.Versioning
+		if md.GroupId != "com.acme" || md.ArtifactId != "lib" || v.Latest != "2.0-SNAPSHOT" || v.Release != "1.10" {
+			t.Fatal("wrong metadata ", md)
+		}
+		if strings.Join(v.Versions, ",") != "1.9,1.10,2.0-SNAPSHOT" || v.LastUpdated == "" {
+			t.Fatal("wrong versions ", v)
+		}
+	})
+	t.Run("snapshot metadata", func(t *testing.T) {
+		md := read(t, "com/acme/lib/2.0-SNAPSHOT/maven-metadata.xml")
+		s := md.Versioning.Snapshot
+		if md.Version != "2.0-SNAPSHOT" || s == nil || s.Timestamp != "20230102.040000" || s.BuildNumber != 2 {
+			t.Fatal("wrong snapshot ", md)
+		}
+		values := []string{}
+		for _, sv := range md.Versioning.SnapshotVersions {
+			values = append(values, sv.Classifier+":"+sv.Extension+":"+sv.Value)
+		}
+		if strings.Join(values, ",") != ":jar:2.0-20230102.040000-2,:pom:2.0-20230102.030405-1,sources:jar:2.0-20230102.040000-2" {
+			t.Fatal("wrong snapshot versions ", values)
+		}
+	})
+	t.Run("sidecars", func(t *testing.T) {
+		h, _ := project.RepositoriesHome()
+		for _, f := range []string{"com/acme/lib/1.9/lib-1.9.jar", "com/acme/lib/maven-metadata.xml"} {
+			p := filepath.Join(h, "maven/releases", f)
+			sum, err := file.Digest(p, sha1.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, _ := os.ReadFile(p + ".sha1"); string(b) != sum {
+				t.Fatalf("wrong sha1: '%s' of: '%s'", string(b), f)
+			}
+			if _, fileExists := file.Exists(p + ".md5"); !fileExists {
+				t.Fatal("md5 not generated for ", f)
+			}
+		}
+	})
+}
+
+func TestCleanup(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"releases": {Hosted: true, Retention: []project.Retention{
+					{Pattern: `-SNAPSHOT$`, KeepSnapshots: 1},
+					{Pattern: `^1\.`, KeepLast: 2},
+					{PrereleaseDays: 30},
+				}},
+			},
+		},
+	}
+	h, _ := project.RepositoriesHome()
+	for _, f := range []string{
+		"1.0/lib-1.0.jar",
+		"1.1/lib-1.1.jar",
+		"1.2/lib-1.2.jar",
+		"2.0-RC1/lib-2.0-RC1.jar",
+		"3.0-SNAPSHOT/lib-3.0-20230102.030405-1.jar",
+		"3.0-SNAPSHOT/lib-3.0-20230103.030405-2.jar",
+	} {
+		artifact := "com/acme/lib/" + f
+		m := Maven{RequestURI: "/maven/releases/" + artifact, Repo: "releases", Artifact: artifact, RequestBody: io.NopCloser(strings.NewReader(f))}
+		if err := m.Publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	rc := filepath.Join(h, "maven/releases/com/acme/lib/2.0-RC1/lib-2.0-RC1.jar")
+	if err := os.Chtimes(rc, old, old); err != nil {
+		t.Fatal(err)
+	}
+	expected := "com.acme:lib:1.0,com.acme:lib:2.0-RC1,com.acme:lib:3.0-20230102.030405-1"
+	versions := func(deleted []yaamartifact.Deleted) string {
+		s := []string{}
+		for _, d := range deleted {
+			s = append(s, d.Artifact+":"+d.Version)
+		}
+		return strings.Join(s, ",")
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		deleted, err := Maven{Repo: "releases"}.Cleanup(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions(deleted) != expected {
+			t.Fatal("wrong versions ", deleted)
+		}
+		if _, fileExists := file.Exists(rc); !fileExists {
+			t.Fatal("file removed by dry run")
+		}
+	})
+	t.Run("cleanup", func(t *testing.T) {
+		deleted, err := Maven{Repo: "releases"}.Cleanup(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions(deleted) != expected {
+			t.Fatal("wrong versions ", deleted)
+		}
+		for _, f := range []string{"1.0", "2.0-RC1", "3.0-SNAPSHOT/lib-3.0-20230102.030405-1.jar", "3.0-SNAPSHOT/lib-3.0-20230102.030405-1.jar.sha1"} {
+			if _, err := os.Stat(filepath.Join(h, "maven/releases/com/acme/lib", f)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("file: '%s' not removed. Error: '%v'", f, err)
+			}
+		}
+		md := Metadata{}
+		b, _ := os.ReadFile(filepath.Join(h, "maven/releases/com/acme/lib/maven-metadata.xml"))
+		if err := xml.Unmarshal(b, &md); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(md.Versioning.Versions, ",") != "1.1,1.2,3.0-SNAPSHOT" || md.Versioning.Release != "1.2" {
+			t.Fatal("wrong metadata ", md.Versioning)
+		}
+		b, _ = os.ReadFile(filepath.Join(h, "maven/releases/com/acme/lib/3.0-SNAPSHOT/maven-metadata.xml"))
+		if err := xml.Unmarshal(b, &md); err != nil {
+			t.Fatal(err)
+		}
+		if len(md.Versioning.SnapshotVersions) != 1 || md.Versioning.SnapshotVersions[0].Value != "3.0-20230103.030405-2" {
+			t.Fatal("wrong snapshot metadata ", md.Versioning)
+		}
+	})
+}
+
+func TestCleanupRestored(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"releases": {Hosted: true, Retention: []project.Retention{{PrereleaseDays: 30}}},
+			},
+		},
+	}
+	backend := t.TempDir()
+	storage.Backend = storage.Local{Dir: backend}
+	defer func() { storage.Backend = nil }()
+	for _, f := range []string{"2.0-RC1/lib-2.0-RC1.jar", "2.0-RC2/lib-2.0-RC2.jar"} {
+		artifact := "com/acme/lib/" + f
+		m := Maven{RequestURI: "/maven/releases/" + artifact, Repo: "releases", Artifact: artifact, RequestBody: io.NopCloser(strings.NewReader(f))}
+		if err := m.Publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(backend, "maven/releases/com/acme/lib/2.0-RC1/lib-2.0-RC1.jar"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	// Cache of new replica, deploy time is kept in backend only
+	h, _ := project.RepositoriesHome()
+	if err := os.RemoveAll(h); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := Maven{Repo: "releases"}.Cleanup(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].Version != "2.0-RC1" {
+		t.Fatal("wrong versions ", deleted)
+	}
+}
+
+func TestNotFoundRemembered(t *testing.T) {
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+	project.Conf = project.ConfigFile{
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Maven: map[string]project.Repos{
+				"central":  {Url: upstream.URL + "/"},
+				"snapshot": {Url: upstream.URL + "/", NotFoundTTL: -1},
+			},
+		},
+	}
+	artifact := "org/test/missing/1.0/missing-1.0.jar"
+	for _, tt := range []struct {
+		repo     string
+		requests int
+	}{
+		{repo: "central", requests: 1},
+		{repo: "snapshot", requests: 2},
+	} {
+		t.Run(tt.repo, func(t *testing.T) {
+			requests = 0
+			for i := 0; i < 2; i++ {
+				m := Maven{ResponseWriter: httptest.NewRecorder(), RequestURI: "/maven/" + tt.repo + "/" + artifact, Repo: tt.repo, Artifact: artifact}
+				if err := m.Preserve(); !errors.Is(err, yaamartifact.NotFoundUpstream) {
+					t.Fatal(err)
+				}
+			}
+			if requests != tt.requests {
+				t.Fatalf("upstream requests: '%d', expected: '%d'", requests, tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package maven
+
+import (
+	"crypto/md5"  // #nosec
+	"crypto/sha1" // #nosec
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metadataFile    = "maven-metadata.xml"
+	snapshotSuffix  = "-SNAPSHOT"
+	timestampFormat = "20060102.150405"
+	updatedFormat   = "20060102150405"
+)
+
+// Sidecar checksums generated for hosted repository
+var sidecars = []struct {
+	ext  string
+	hash func() hash.Hash
+}{
+	{".sha1", sha1.New},
+	{".md5", md5.New},
+}
+
+// Metadata is written by one deploy at a time
+var metadataMutex sync.Mutex
+
+type Metadata struct {
+	XMLName    xml.Name   `xml:"metadata"`
+	ModelVer   string     `xml:"modelVersion,attr,omitempty"`
+	GroupId    string     `xml:"groupId"`
+	ArtifactId string     `xml:"artifactId"`
+	Version    string     `xml:"version,omitempty"`
+	Versioning Versioning `xml:"versioning"`
+}
+type Versioning struct {
+	Latest           string            `xml:"latest,omitempty"`
+	Release          string            `xml:"release,omitempty"`
+	Versions         []string          `xml:"versions>version,omitempty"`
+	Snapshot         *Snapshot         `xml:"snapshot,omitempty"`
+	LastUpdated      string            `xml:"lastUpdated"`
+	SnapshotVersions []SnapshotVersion `xml:"snapshotVersions>snapshotVersion,omitempty"`
+}
+type Snapshot struct {
+	Timestamp   string `xml:"timestamp"`
+	BuildNumber int    `xml:"buildNumber"`
+}
+type SnapshotVersion struct {
+	Classifier string `xml:"classifier,omitempty"`
+	Extension  string `xml:"extension"`
+	Value      string `xml:"value"`
+	Updated    string `xml:"updated"`
+}
+
+// Coordinates of deployed file com/acme/lib/1.0/lib-1.0.jar
+type coordinates struct {
+	GroupId, ArtifactId, Version, File string
+}
+
+func parseCoordinates(artifact string) (coordinates, error) {
+	parts := strings.Split(strings.Trim(artifact, "/"), "/")
+	if len(parts) < 4 {
+		return coordinates{}, fmt.Errorf("path: '%s' is not groupId/artifactId/version/file", artifact)
+	}
+	n := len(parts)
+	c := coordinates{
+		GroupId:    strings.Join(parts[:n-3], "."),
+		ArtifactId: parts[n-3],
+		Version:    parts[n-2],
+		File:       parts[n-1],
+	}
+	if !strings.HasPrefix(c.File, c.ArtifactId+"-") {
+		return coordinates{}, fmt.Errorf("file: '%s' is not artifact: '%s'", c.File, c.ArtifactId)
+	}
+	return c, nil
+}
+
+// Sidecar checksums and signatures do not change metadata
+func isSidecar(f string) bool {
+	switch filepath.Ext(f) {
+	case ".sha1", ".sha256", ".sha512", ".md5", ".asc":
+		return true
+	}
+	return false
+}
+
+// Write .sha1 and .md5 of file, existing sidecars are kept unless overwrite
+func writeSidecars(f string, overwrite bool) error {
+	for _, s := range sidecars {
+		sf := f + s.ext
+		if _, fileExists := file.Exists(sf); fileExists && !overwrite {
+			continue
+		}
+		sum, err := file.Digest(f, s.hash())
+		if err != nil {
+			return err
+		}
+		if err := file.WriteFile(sf, []byte(sum)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metadata document with XML header
+func marshalMetadata(md Metadata) ([]byte, error) {
+	b, err := xml.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// Write metadata with sidecars
+func writeMetadata(f string, md Metadata) error {
+	b, err := marshalMetadata(md)
+	if err != nil {
+		return err
+	}
+	if err := file.WriteFile(f, b); err != nil {
+		return err
+	}
+	return writeSidecars(f, true)
+}
+
+// Merge metadata of group members: versions of all members, highest latest
+// and release and last update of members, other fields are of first member
+func mergeMetadata(docs []Metadata) Metadata {
+	merged := docs[0]
+	versions := []string{}
+	seen := map[string]bool{}
+	for _, md := range docs {
+		for _, v := range md.Versioning.Versions {
+			if !seen[v] {
+				seen[v] = true
+				versions = append(versions, v)
+			}
+		}
+		if compareVersions(md.Versioning.Latest, merged.Versioning.Latest) > 0 {
+			merged.Versioning.Latest = md.Versioning.Latest
+		}
+		if compareVersions(md.Versioning.Release, merged.Versioning.Release) > 0 {
+			merged.Versioning.Release = md.Versioning.Release
+		}
+		// yyyyMMddHHmmss is ordered as string
+		if md.Versioning.LastUpdated > merged.Versioning.LastUpdated {
+			merged.Versioning.LastUpdated = md.Versioning.LastUpdated
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+	merged.Versioning.Versions = versions
+	return merged
+}
+
+// Split version to numbers and qualifiers 1.0-RC1 -> [1 0 rc 1]
+func versionTokens(v string) []string {
+	re := regexp.MustCompile(`[0-9]+|[a-zA-Z]+`)
+	return re.FindAllString(strings.ToLower(v), -1)
+}
+
+// Order of known qualifiers, unknown qualifiers are after snapshot
+func qualifierOrder(q string) int {
+	switch q {
+	case "alpha", "a":
+		return 1
+	case "beta", "b":
+		return 2
+	case "milestone", "m":
+		return 3
+	case "rc", "cr":
+		return 4
+	case "snapshot":
+		return 5
+	case "", "ga", "final", "release":
+		return 7
+	case "sp":
+		return 8
+	}
+	return 6
+}
+
+// Compare maven versions: numbers numerically, release after qualifiers
+func compareVersions(a, b string) int {
+	ta, tb := versionTokens(a), versionTokens(b)
+	for i := 0; i < len(ta) || i < len(tb); i++ {
+		var x, y string
+		if i < len(ta) {
+			x = ta[i]
+		}
+		if i < len(tb) {
+			y = tb[i]
+		}
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil:
+			if nx != ny {
+				return nx - ny
+			}
+		case errx == nil:
+			// 1.0.1 > 1.0-beta, 1.0.1 > 1.0
+			return 1
+		case erry == nil:
+			return -1
+		default:
+			ox, oy := qualifierOrder(x), qualifierOrder(y)
+			if ox != oy {
+				return ox - oy
+			}
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// Versions of artifact are directories with files
+func artifactVersions(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !f.IsDir() {
+				versions = append(versions, e.Name())
+				break
+			}
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+	return versions, nil
+}
+
+// Artifact level metadata with all versions of artifact
+func artifactMetadata(dir string, c coordinates, now time.Time) (Metadata, error) {
+	versions, err := artifactVersions(dir)
+	if err != nil {
+		return Metadata{}, err
+	}
+	md := Metadata{GroupId: c.GroupId, ArtifactId: c.ArtifactId}
+	md.Versioning.Versions = versions
+	md.Versioning.LastUpdated = now.UTC().Format(updatedFormat)
+	for _, v := range versions {
+		md.Versioning.Latest = v
+		if !strings.HasSuffix(v, snapshotSuffix) {
+			md.Versioning.Release = v
+		}
+	}
+	return md, nil
+}
+
+// Files of SNAPSHOT build are
+// {artifactId}-{base}-{yyyyMMdd.HHmmss}-{buildNumber}[-{classifier}].{ext}
+func snapshotPattern(c coordinates) *regexp.Regexp {
+	base := strings.TrimSuffix(c.Version, snapshotSuffix)
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(c.ArtifactId+"-"+base) + `-([0-9]{8}\.[0-9]{6})-([0-9]+)(-[^.]+)?\.(.+)$`)
+}
+
+// Snapshot level metadata with last timestamp and build number
+func snapshotMetadata(dir string, c coordinates, now time.Time) (Metadata, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Metadata{}, err
+	}
+	base := strings.TrimSuffix(c.Version, snapshotSuffix)
+	re := snapshotPattern(c)
+	md := Metadata{ModelVer: "1.1.0", GroupId: c.GroupId, ArtifactId: c.ArtifactId, Version: c.Version}
+	md.Versioning.LastUpdated = now.UTC().Format(updatedFormat)
+	latest := map[string]SnapshotVersion{}
+	var snapshot *Snapshot
+	for _, e := range entries {
+		if e.IsDir() || isSidecar(e.Name()) {
+			continue
+		}
+		m := re.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		build, _ := strconv.Atoi(m[2])
+		if snapshot == nil || m[1] > snapshot.Timestamp || m[1] == snapshot.Timestamp && build > snapshot.BuildNumber {
+			snapshot = &Snapshot{Timestamp: m[1], BuildNumber: build}
+		}
+		sv := SnapshotVersion{
+			Classifier: strings.TrimPrefix(m[3], "-"),
+			Extension:  m[4],
+			Value:      fmt.Sprintf("%s-%s-%s", base, m[1], m[2]),
+		}
+		if t, err := time.Parse(timestampFormat, m[1]); err == nil {
+			sv.Updated = t.Format(updatedFormat)
+		}
+		key := sv.Classifier + ":" + sv.Extension
+		if old, ok := latest[key]; !ok || compareVersions(sv.Value, old.Value) > 0 {
+			latest[key] = sv
+		}
+	}
+	md.Versioning.Snapshot = snapshot
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		md.Versioning.SnapshotVersions = append(md.Versioning.SnapshotVersions, latest[k])
+	}
+	return md, nil
+}
+
+// Regenerate artifact level and snapshot level metadata after deploy of file
+// to hosted repository, file path is {home}/maven/{repo}/{artifact}
+func updateMetadata(repoDir, artifact string) error {
+	c, err := parseCoordinates(artifact)
+	if err != nil {
+		return err
+	}
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	now := time.Now()
+	versionDir := filepath.Join(repoDir, filepath.FromSlash(artifact), "..")
+	artifactDir := filepath.Dir(versionDir)
+	// Versions deployed to other replicas are listed too
+	if err := storage.SyncDir(artifactDir); err != nil {
+		return err
+	}
+	if strings.HasSuffix(c.Version, snapshotSuffix) {
+		md, err := snapshotMetadata(versionDir, c, now)
+		if err != nil {
+			return err
+		}
+		if err := writeMetadata(filepath.Join(versionDir, metadataFile), md); err != nil {
+			return err
+		}
+	}
+	md, err := artifactMetadata(artifactDir, c, now)
+	if err != nil {
+		return err
+	}
+	if err := writeMetadata(filepath.Join(artifactDir, metadataFile), md); err != nil {
+		return err
+	}
+	log.Debugf("metadata of: '%s:%s' updated, versions: '%v'", c.GroupId, c.ArtifactId, md.Versioning.Versions)
+	return nil
+}
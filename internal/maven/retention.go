@@ -0,0 +1,263 @@
+package maven
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version with alpha, beta, milestone, rc qualifier or SNAPSHOT
+func isPrerelease(v string) bool {
+	for _, t := range versionTokens(v) {
+		if o := qualifierOrder(t); o >= 1 && o <= 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// Time of last deploy to version directory, generated sidecars and metadata
+// are not deployed files. Files restored from storage keep modification time
+// of object.
+func deployTime(dir string) (time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var t time.Time
+	for _, e := range entries {
+		if e.IsDir() || skipChecksum(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// Artifact directories of repository have artifact level metadata
+func artifactDirs(repoDir string) (map[string]coordinates, error) {
+	dirs := map[string]coordinates{}
+	err := filepath.WalkDir(repoDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() != metadataFile {
+			return nil
+		}
+		b, err := os.ReadFile(filepath.Clean(p))
+		if err != nil {
+			return err
+		}
+		md := Metadata{}
+		if err := xml.Unmarshal(b, &md); err != nil {
+			log.Warnf("metadata: '%s' skipped. Error: '%v'", p, err)
+			return nil
+		}
+		if md.Version == "" && md.ArtifactId != "" {
+			dirs[filepath.Dir(p)] = coordinates{GroupId: md.GroupId, ArtifactId: md.ArtifactId}
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// Timestamped builds of SNAPSHOT version {base}-{timestamp}-{buildNumber}
+// from oldest to newest
+func snapshotBuilds(dir string, c coordinates) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(c.Version, snapshotSuffix)
+	re := snapshotPattern(c)
+	found := map[string]bool{}
+	builds := []string{}
+	for _, e := range entries {
+		m := re.FindStringSubmatch(e.Name())
+		if e.IsDir() || isSidecar(e.Name()) || m == nil {
+			continue
+		}
+		b := fmt.Sprintf("%s-%s-%s", base, m[1], m[2])
+		if !found[b] {
+			found[b] = true
+			builds = append(builds, b)
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool { return compareVersions(builds[i], builds[j]) < 0 })
+	return builds, nil
+}
+
+// Remove files of SNAPSHOT build with sidecars
+func removeBuild(dir string, c coordinates, build string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	prefix := c.ArtifactId + "-" + build
+	for _, e := range entries {
+		rest := strings.TrimPrefix(e.Name(), prefix)
+		if e.IsDir() || rest == e.Name() || !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "-") {
+			continue
+		}
+		if err := storage.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply retention rules to versions and SNAPSHOT builds of artifact and
+// regenerate its metadata
+func cleanupArtifact(repo, dir string, c coordinates, rules []project.Retention, dryRun bool, now time.Time) ([]artifact.Deleted, error) {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	deleted := []artifact.Deleted{}
+	name := c.GroupId + ":" + c.ArtifactId
+	names, err := artifactVersions(dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := []artifact.Version{}
+	for _, v := range names {
+		t, err := deployTime(filepath.Join(dir, v))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, artifact.Version{Name: v, Published: t, Prerelease: isPrerelease(v)})
+	}
+	expired, err := artifact.Expired(rules, versions, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range artifact.SortedKeys(expired) {
+		deleted = append(deleted, artifact.Deleted{Repo: repo, Artifact: name, Version: v, Reason: expired[v]})
+		if dryRun {
+			continue
+		}
+		if err := storage.RemoveAll(filepath.Join(dir, v)); err != nil {
+			return nil, err
+		}
+		log.Infof("maven artifact: '%s:%s' deleted from: '%s', %s", name, v, repo, expired[v])
+	}
+
+	for _, v := range names {
+		if _, ok := expired[v]; ok || !strings.HasSuffix(v, snapshotSuffix) {
+			continue
+		}
+		sc := coordinates{GroupId: c.GroupId, ArtifactId: c.ArtifactId, Version: v}
+		versionDir := filepath.Join(dir, v)
+		builds, err := snapshotBuilds(versionDir, sc)
+		if err != nil {
+			return nil, err
+		}
+		keep := len(builds)
+		for _, rule := range rules {
+			if rule.KeepSnapshots > 0 && rule.KeepSnapshots < keep && matches(rule.Pattern, v) {
+				keep = rule.KeepSnapshots
+			}
+		}
+		if keep == len(builds) {
+			continue
+		}
+		for _, b := range builds[:len(builds)-keep] {
+			reason := fmt.Sprintf("not in last: '%d' snapshot builds", keep)
+			deleted = append(deleted, artifact.Deleted{Repo: repo, Artifact: name, Version: b, Reason: reason})
+			if dryRun {
+				continue
+			}
+			if err := removeBuild(versionDir, sc, b); err != nil {
+				return nil, err
+			}
+			log.Infof("maven artifact: '%s:%s' deleted from: '%s', %s", name, b, repo, reason)
+		}
+		if dryRun {
+			continue
+		}
+		md, err := snapshotMetadata(versionDir, sc, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeMetadata(filepath.Join(versionDir, metadataFile), md); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun || len(deleted) == 0 {
+		return deleted, nil
+	}
+	if len(expired) == len(names) {
+		return deleted, storage.RemoveAll(dir)
+	}
+	md, err := artifactMetadata(dir, c, now)
+	if err != nil {
+		return nil, err
+	}
+	return deleted, writeMetadata(filepath.Join(dir, metadataFile), md)
+}
+
+// Version matches pattern of rule, empty pattern matches all versions
+func matches(pattern, version string) bool {
+	if pattern == "" {
+		return true
+	}
+	re, err := regexp.Compile(pattern)
+	return err == nil && re.MatchString(version)
+}
+
+// Cleanup apply retention rules of hosted repository to all its artifacts
+func (m Maven) Cleanup(dryRun bool) ([]artifact.Deleted, error) {
+	repo := project.Conf.GetRepos("maven")[m.Repo]
+	if !repo.Hosted || len(repo.Retention) == 0 {
+		return []artifact.Deleted{}, nil
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return nil, err
+	}
+	repoDir := filepath.Join(h, "maven", m.Repo)
+	if err := storage.SyncDir(repoDir); err != nil {
+		return nil, err
+	}
+	dirs, err := artifactDirs(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		keys = append(keys, dir)
+	}
+	sort.Strings(keys)
+	deleted := []artifact.Deleted{}
+	now := time.Now()
+	for _, dir := range keys {
+		d, err := cleanupArtifact(m.Repo, dir, dirs[dir], repo.Retention, dryRun, now)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, d...)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,259 @@
+package npm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	NpmNotFound      = errors.New("npm package not found")
+	NpmTagNotValid   = errors.New("npm dist-tag is invalid")
+	NpmPathNotValid  = errors.New("npm package path is invalid")
+	NpmRepoNotHosted = errors.New("npm repository is not hosted")
+)
+
+// Manifest of package is changed by one request at a time, lock is removed
+// when no request holds or waits for it
+type manifestLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	manifestLocksMutex sync.Mutex
+	manifestLocks      = map[string]*manifestLock{}
+)
+
+// Lock manifest file, returned func unlocks it
+func lockManifest(mf string) func() {
+	manifestLocksMutex.Lock()
+	l, ok := manifestLocks[mf]
+	if !ok {
+		l = &manifestLock{}
+		manifestLocks[mf] = l
+	}
+	l.refs++
+	manifestLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		manifestLocksMutex.Lock()
+		defer manifestLocksMutex.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(manifestLocks, mf)
+		}
+	}
+}
+
+// Path to manifest of package in hosted repository
+func manifestPath(repo, pkg string) (string, error) {
+	if !project.Conf.IsHosted("npm", repo) {
+		return "", fmt.Errorf("%w: '%s'", NpmRepoNotHosted, repo)
+	}
+	if pkg == "" || strings.Contains(pkg, "..") {
+		return "", fmt.Errorf("%w: '%s'", NpmPathNotValid, pkg)
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(h, "npm", repo, packagePath(pkg)+".tmp"), nil
+}
+
+// Read manifest of package from hosted repository
+func hostedManifest(repo, pkg string) (string, NpmPackage, error) {
+	mf, err := manifestPath(repo, pkg)
+	if err != nil {
+		return "", NpmPackage{}, err
+	}
+	npm, err := readManifest(mf)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", npm, fmt.Errorf("%w: '%s'", NpmNotFound, pkg)
+	}
+	return mf, npm, err
+}
+
+// Lock and read manifest of package from hosted repository, returned func
+// unlocks it
+func lockedManifest(repo, pkg string) (string, NpmPackage, func(), error) {
+	mf, err := manifestPath(repo, pkg)
+	if err != nil {
+		return "", NpmPackage{}, nil, err
+	}
+	unlock := lockManifest(mf)
+	mf, npm, err := hostedManifest(repo, pkg)
+	if err != nil {
+		unlock()
+		return "", npm, nil, err
+	}
+	return mf, npm, unlock, nil
+}
+
+// Update manifest of package in hosted repository with manifest locked,
+// update is run again on manifest changed by other replica meanwhile
+func updateManifest(repo, pkg string, update func(mf string, npm *NpmPackage) error) error {
+	mf, err := manifestPath(repo, pkg)
+	if err != nil {
+		return err
+	}
+	defer lockManifest(mf)()
+	return storage.RetryOnConflict(func() error {
+		mf, npm, err := hostedManifest(repo, pkg)
+		if err != nil {
+			return err
+		}
+		if err := update(mf, &npm); err != nil {
+			return err
+		}
+		return writeManifest(mf, npm)
+	})
+}
+
+// Next revision of manifest 1-xxx -> 2-yyy
+func bumpRev(npm *NpmPackage) {
+	n, _ := strconv.Atoi(strings.SplitN(npm.Rev, "-", 2)[0])
+	npm.Rev = fmt.Sprintf("%d-%x", n+1, time.Now().UnixNano())
+}
+
+// Remove tarball of version from disk
+func removeTarball(mf string, npm NpmPackage, version string) error {
+	pack := fmt.Sprintf("%s-%s.tgz", path.Base(npm.Name), version)
+	f := filepath.Join(strings.TrimSuffix(mf, ".tmp"), "-", pack)
+	if err := storage.Remove(f); err != nil {
+		return err
+	}
+	log.Infof("npm package: '%s@%s' unpublished", npm.Name, version)
+	return nil
+}
+
+// DistTags return dist-tags of package
+func DistTags(repo, pkg string) (map[string]interface{}, error) {
+	_, npm, err := hostedManifest(repo, pkg)
+	if err != nil {
+		return nil, err
+	}
+	return toMap(npm.DistTags), nil
+}
+
+// SetDistTag point tag to existing version of package
+func SetDistTag(repo, pkg, tag, version string) (map[string]interface{}, error) {
+	var tags map[string]interface{}
+	err := updateManifest(repo, pkg, func(mf string, npm *NpmPackage) error {
+		if _, ok := npm.Versions[version]; !ok {
+			return fmt.Errorf("%w: version '%s@%s'", NpmNotFound, pkg, version)
+		}
+		tags = toMap(npm.DistTags)
+		tags[tag] = version
+		npm.DistTags = tags
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// RemoveDistTag remove tag from package, latest can not be removed
+func RemoveDistTag(repo, pkg, tag string) (map[string]interface{}, error) {
+	if tag == "latest" {
+		return nil, fmt.Errorf("%w: dist-tag 'latest' can not be removed", NpmTagNotValid)
+	}
+	var tags map[string]interface{}
+	err := updateManifest(repo, pkg, func(mf string, npm *NpmPackage) error {
+		tags = toMap(npm.DistTags)
+		if _, ok := tags[tag]; !ok {
+			return fmt.Errorf("%w: dist-tag '%s' of '%s'", NpmNotFound, tag, pkg)
+		}
+		delete(tags, tag)
+		npm.DistTags = tags
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// UpdateManifest apply manifest sent by npm deprecate and npm unpublish:
+// deprecated messages are copied, with unpublish versions missing in document
+// are removed with tarballs.
+func UpdateManifest(repo, pkg string, doc NpmPackage, unpublish bool) error {
+	return updateManifest(repo, pkg, func(mf string, npm *NpmPackage) error {
+		if doc.Name != npm.Name || len(doc.Versions) == 0 {
+			return fmt.Errorf("%w: manifest of '%s' has no versions or other name", NpmPublishNotValid, pkg)
+		}
+		times := toMap(npm.Time)
+		for version, p := range npm.Versions {
+			d, ok := doc.Versions[version]
+			if !ok && !unpublish {
+				continue
+			}
+			if !ok {
+				if err := removeTarball(mf, *npm, version); err != nil {
+					return err
+				}
+				delete(npm.Versions, version)
+				delete(times, version)
+				continue
+			}
+			p.Deprecared = d.Deprecared
+			if msg, ok := p.Deprecared.(string); ok && msg == "" {
+				p.Deprecared = nil
+			}
+			npm.Versions[version] = p
+		}
+		tags := map[string]interface{}{}
+		for tag, version := range toMap(doc.DistTags) {
+			if v, ok := version.(string); ok {
+				if _, ok := npm.Versions[v]; ok {
+					tags[tag] = v
+				}
+			}
+		}
+		npm.DistTags = tags
+		times["modified"] = time.Now().UTC().Format(time.RFC3339Nano)
+		npm.Time = times
+		return nil
+	})
+}
+
+// Unpublish remove package with all versions or one tarball
+// {pkg}/-/{pkg}-{ver}.tgz (tarball version must be removed from manifest before)
+func Unpublish(repo, pkg string) error {
+	if name, tarball, ok := strings.Cut(packagePath(pkg), "/-/"); ok {
+		mf, _, unlock, err := lockedManifest(repo, name)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		f := filepath.Join(strings.TrimSuffix(mf, ".tmp"), "-", path.Base(tarball))
+		return storage.Remove(f)
+	}
+	mf, npm, unlock, err := lockedManifest(repo, pkg)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := storage.RemoveAll(strings.TrimSuffix(mf, ".tmp")); err != nil {
+		return err
+	}
+	if err := storage.Remove(mf); err != nil {
+		return err
+	}
+	log.Infof("npm package: '%s' with: '%d' versions unpublished", npm.Name, len(npm.Versions))
+	return nil
+}
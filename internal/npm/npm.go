@@ -14,9 +14,11 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/morhayn/yaam2/internal/api"
 	"github.com/morhayn/yaam2/internal/artifact"
 	"github.com/morhayn/yaam2/internal/file"
 	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -94,10 +96,13 @@ type Sign struct {
 
 type Npm struct {
 	ResponseWriter http.ResponseWriter
+	Request        *http.Request
 	RequestBody    io.ReadCloser
 	RequestURI     string
 	Repo           string
 	Artifact       string
+	// Scheme and host of yaam for tarball urls in manifests
+	BaseUrl string
 }
 
 var (
@@ -117,7 +122,7 @@ func replaceUrlPublicNpmWithYaamHost(f, repo, artifact string) error {
 	err = json.Unmarshal([]byte(input), &npm)
 	if err != nil {
 		//Remove brocken manifest - no Unmarshell - no data for package
-		err = os.Remove(filepath.Clean(f))
+		err = storage.Remove(filepath.Clean(f))
 		if err != nil {
 			panic(fmt.Sprintf("!!! broken npm not delete !!! %s", f))
 		}
@@ -126,7 +131,7 @@ func replaceUrlPublicNpmWithYaamHost(f, repo, artifact string) error {
 	// If Version in npm manifeste not exists manifest not valide
 	if len(npm.Versions) == 0 {
 		//Remove brocken npm manifest - no Versions - no Packages
-		err = os.Remove(filepath.Clean(f))
+		err = storage.Remove(filepath.Clean(f))
 		if err != nil {
 			panic("!!! broken npm not delete !!!")
 		}
@@ -136,13 +141,13 @@ func replaceUrlPublicNpmWithYaamHost(f, repo, artifact string) error {
 	for key, vers := range npm.Versions {
 		pack := path.Base(vers.Dist.Tarball)
 		v := npm.Versions[key]
-		v.Dist.Tarball = fmt.Sprintf("http://%s/npm/%s/%s/-/%s", project.Conf.HostAndPort(), repo, npm.Name, pack)
+		v.Dist.Tarball = tarballUrl(repo, npm.Name, pack)
 		npm.Versions[key] = v
 	}
 	//Write to disk new manifest for use and send clients
-	file, _ := json.Marshal(npm)
+	manifest, _ := json.Marshal(npm)
 	// output := strings.Replace(string(input), "https://registry.npmjs.org", "http://"+host+"/npm/3rdparty-npm", -1)
-	err = os.WriteFile(f, []byte(file), 0o600)
+	err = file.WriteFile(f, manifest)
 	if err != nil {
 		return err
 	}
@@ -157,6 +162,31 @@ func replaceUrlPublicNpmWithYaamHost(f, repo, artifact string) error {
 	return nil
 }
 
+// Path of package tarball in yaam repository, host is added at read time
+func tarballUrl(repo, name, pack string) string {
+	return fmt.Sprintf("/npm/%s/%s/-/%s", repo, name, pack)
+}
+
+// Add base url of request to tarball paths. Manifests cached by old versions
+// contain http://localhost:port host, it is replaced too.
+func rewriteTarballs(npm *NpmPackage, baseUrl string) {
+	legacy := "http://" + project.Conf.HostAndPort()
+	for key, v := range npm.Versions {
+		tb := strings.TrimPrefix(v.Dist.Tarball, legacy)
+		if strings.HasPrefix(tb, "/") {
+			v.Dist.Tarball = strings.TrimSuffix(baseUrl, "/") + tb
+			npm.Versions[key] = v
+		}
+	}
+}
+
+// Send manifest to client with tarball urls of yaam host
+func (n Npm) sendManifest(npm NpmPackage) error {
+	rewriteTarballs(&npm, n.BaseUrl)
+	n.ResponseWriter.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(n.ResponseWriter).Encode(npm)
+}
+
 func firstMatch(f, regex string) (string, error) {
 	re := regexp.MustCompile(regex)
 	match := re.FindStringSubmatch(f)
@@ -236,60 +266,82 @@ func compareChecksumOnDiskWithExpectedSha(expChecksum, pathTmp string) (bool, er
 	return checksumValid, nil
 }
 
-func checksum(f string) (bool, error) {
-	checksumValid := true
-	_, fileExists := file.Exists(f)
-	if fileExists && filepath.Ext(f) == ".tgz" {
-		fmt.Println(f)
-		vs, err := versionShasum(f)
+// Verify package tmp downloaded for f with shasum of version in manifest,
+// package is not verified if manifest of package is not cached
+func checksum(f, tmp string) (bool, error) {
+	if filepath.Ext(f) != ".tgz" {
+		return true, nil
+	}
+	vs, err := versionShasum(f)
+	if err != nil || vs == "" {
+		log.Warnf("checksum of: '%s' not found, package not verified. Error: '%v'", f, err)
+		return true, nil
+	}
+	return compareChecksumOnDiskWithExpectedSha(vs, tmp)
+}
+
+// Verify package or manifest before it is saved
+func verifyDownload(f, tmp string) error {
+	switch filepath.Ext(f) {
+	case ".tgz":
+		checksumValid, err := checksum(f, tmp)
 		if err != nil {
-			return checksumValid, err
+			return err
 		}
-		checksumValid, err := compareChecksumOnDiskWithExpectedSha(vs, f)
+		if !checksumValid {
+			return CheckSumNotValid
+		}
+	case ".tmp":
+		b, err := os.ReadFile(filepath.Clean(tmp))
 		if err != nil {
-			fmt.Println("Checksum error")
-			return checksumValid, err
+			return err
+		}
+		if !json.Valid(b) {
+			log.Errorf("json file: '%s' is invalid", f)
+			return NpmManifestNotValid
 		}
 	}
-	return checksumValid, nil
+	return nil
 }
 
-// Save file manifest(.tmp) and package(.tgz) to disk  validate json
+// Save file manifest(.tmp) and package(.tgz) to disk, broken file is not saved
 func (n Npm) SaveToDisk(a artifact.Artefact, resp *http.Response) error {
-	if resp.StatusCode == http.StatusOK {
-		if err := file.CreateIfDoesNotExistInvalidOrEmpty(a.Url, a.Path, resp.Body, false); err != nil {
-			fmt.Println(err)
-			return err
-		}
-		if filepath.Ext(a.Path) == ".tgz" {
-			checksumValid, err := checksum(a.Path)
-			if err != nil {
-				return err
-			}
-			// Remove brocken file with checksum not valid
-			if !checksumValid {
-				os.Remove(a.Path)
-				return CheckSumNotValid
-			}
-		}
-		if filepath.Ext(a.Path) == ".tmp" {
-			b, err := os.ReadFile(filepath.Clean(a.Path))
-			if err != nil {
-				return err
-			}
-			//Remove brocken file if json not valid
-			if !json.Valid(b) {
-				log.Errorf("json file: '%s' is invalid", a.Path)
-				os.Remove(a.Path)
-				return NpmManifestNotValid
-			}
-		}
-	} else {
+	if resp.StatusCode != http.StatusOK {
 		return errors.New(fmt.Sprintf("Download not comleated statusCode %d", resp.StatusCode))
 	}
+	verify := func(tmp string) error {
+		return verifyDownload(a.Path, tmp)
+	}
+	if err := file.CreateIfDoesNotExistInvalidOrEmpty(a.Url, a.Path, resp.Body, false, verify); err != nil {
+		fmt.Println(err)
+		return err
+	}
 	return nil
 }
 
+// Send package to client while it is downloaded, package is cached only if
+// checksum matches manifest
+func (n Npm) stream(a artifact.Artefact, repo artifact.PublicRepository) error {
+	resp, err := repo.Download(a.Url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return artifact.RememberNotFound(a, project.Conf.Caches.Npm[n.Repo].NegativeTTL())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: '%s' not completed statusCode: '%d'", a.Url, resp.StatusCode)
+	}
+	return artifact.Stream(n.ResponseWriter, resp, a.Path, func(tmp string) error {
+		return verifyDownload(a.Path, tmp)
+	})
+}
+
 // Load from external repository package and manifest
 func (n Npm) Preserve(urlStrings ...string) error {
 	fmt.Println(n.RequestURI)
@@ -297,6 +349,10 @@ func (n Npm) Preserve(urlStrings ...string) error {
 	if len(urlStrings) > 0 {
 		urlString = urlStrings[0]
 	}
+	// Hosted repository has no upstream, packages are served from disk
+	if project.Conf.IsHosted("npm", n.Repo) {
+		return nil
+	}
 	repoInConfigFile, err := artifact.RepoInConfigFile(urlString, n.Repo, project.Conf.Caches.Npm)
 	if err != nil {
 		return err
@@ -306,7 +362,7 @@ func (n Npm) Preserve(urlStrings ...string) error {
 		if err != nil {
 			return err
 		}
-		dir := strings.Replace(urlString, "%2f", "/", -1)
+		dir := packagePath(urlString)
 		log.Debugf("extension found: '%s', file: '%s'", filepath.Ext(dir), dir)
 		if filepath.Ext(dir) != ".tgz" {
 			log.Debugf("file: '%s' does not have an extension", dir)
@@ -324,53 +380,200 @@ func (n Npm) Preserve(urlStrings ...string) error {
 		artifact.CloseUrlRepo(rep.Url)
 		du := fmt.Sprintf("%s%s", rep.Url, n.Artifact)
 
-		completeFile := filepath.Join(h, dir)
-		// Fail .tgz exists and not download again
-		if filepath.Ext(dir) == ".tgz" {
-			if _, err = os.Stat(completeFile); err == nil {
-				return nil
-			}
-		}
+		a := artifact.Artefact{Path: filepath.Join(h, dir), Url: du}
+		// One fetch of package or manifest at a time, concurrent requests wait
+		// for it
+		return artifact.Fetch(a.Path, func() error { return n.fetch(a, repoInConfigFile) })
+	}
+	return nil
+}
 
-		a := artifact.Artefact{Path: completeFile, Url: du}
-		resp, err := file.DownloadWithRetries(a.Url)
-		if err != nil {
-			return err
+// Download package if not cached or manifest from upstream
+func (n Npm) fetch(a artifact.Artefact, repo artifact.PublicRepository) error {
+	// Fail .tgz exists and not download again
+	if filepath.Ext(a.Path) == ".tgz" {
+		if _, err := os.Stat(a.Path); err == nil {
+			return nil
 		}
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				panic(err)
-			}
-		}()
-		if err := n.SaveToDisk(a, resp); err != nil {
-			return err
+		if artifact.Streamable(n.ResponseWriter, n.Request) {
+			return n.stream(a, repo)
 		}
-		if filepath.Ext(dir) != ".tgz" {
-			if err := replaceUrlPublicNpmWithYaamHost(completeFile, n.Repo, n.Artifact); err != nil {
-				return err
-			}
+	}
+	resp, err := repo.Download(a.Url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if _, fileExists := file.Exists(a.Path); !fileExists && resp.StatusCode == http.StatusNotFound {
+		return artifact.RememberNotFound(a, project.Conf.Caches.Npm[n.Repo].NegativeTTL())
+	}
+	if err := n.SaveToDisk(a, resp); err != nil {
+		return err
+	}
+	if filepath.Ext(a.Path) != ".tgz" {
+		if err := replaceUrlPublicNpmWithYaamHost(a.Path, n.Repo, n.Artifact); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// push npm package
+// push npm package, body is npm publish document with tarball in attachments
 func (n Npm) Publish() error {
-	if err := artifact.StoreOnDisk(n.RequestURI, n.RequestBody); err != nil {
+	name, err := publish(n.RequestURI, n.Repo, n.RequestBody)
+	if err != nil {
 		return err
 	}
-	return nil
+	n.ResponseWriter.Header().Set("Content-Type", "application/json")
+	n.ResponseWriter.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(n.ResponseWriter).Encode(map[string]interface{}{"ok": true, "id": name})
 }
 
 // Send to clent npm package or manifest
 func (n Npm) Read() error {
-	reqUrlString := strings.Replace(n.RequestURI, "%2f", "/", -1)
+	reqUrlString := packagePath(n.RequestURI)
 	if filepath.Ext(reqUrlString) != ".tgz" {
 		log.Tracef("file: '%s' does not have an extension", reqUrlString)
-		reqUrlString = reqUrlString + ".tmp"
+		h, err := project.RepositoriesHome()
+		if err != nil {
+			return err
+		}
+		npm, err := readManifest(filepath.Join(h, reqUrlString+".tmp"))
+		if err != nil {
+			return fmt.Errorf(file.CannotReadErrMsg, err)
+		}
+		return n.sendManifest(npm)
 	}
-	if err := artifact.ReadFromDisk(n.ResponseWriter, reqUrlString); err != nil {
+	if err := artifact.ReadFromDisk(n.ResponseWriter, n.Request, reqUrlString); err != nil {
 		return fmt.Errorf(file.CannotReadErrMsg, err)
 	}
 	return nil
 }
+
+// Member repository request for group
+func (n Npm) member(repo string) Npm {
+	return Npm{
+		ResponseWriter: n.ResponseWriter,
+		Request:        n.Request,
+		RequestBody:    n.RequestBody,
+		RequestURI:     "/npm/" + repo + "/" + n.Artifact,
+		Repo:           repo,
+		Artifact:       n.Artifact,
+		BaseUrl:        n.BaseUrl,
+	}
+}
+
+// Merge versions, dist-tags and time from manifests of members, first
+// member in priority order wins
+func mergeManifests(manifests []NpmPackage) (NpmPackage, error) {
+	if len(manifests) == 0 {
+		return NpmPackage{}, NpmManifestEmpty
+	}
+	merged := manifests[0]
+	versions := map[string]Package{}
+	tags := map[string]interface{}{}
+	times := map[string]interface{}{}
+	for _, m := range manifests {
+		for v, p := range m.Versions {
+			if _, ok := versions[v]; !ok {
+				versions[v] = p
+			}
+		}
+		if dt, ok := m.DistTags.(map[string]interface{}); ok {
+			for tag, v := range dt {
+				if _, ok := tags[tag]; !ok {
+					tags[tag] = v
+				}
+			}
+		}
+		// Publish time of version is of member serving it
+		if tm, ok := m.Time.(map[string]interface{}); ok {
+			for k, v := range tm {
+				if _, ok := times[k]; !ok {
+					times[k] = v
+				}
+			}
+		}
+	}
+	merged.Versions = versions
+	merged.DistTags = tags
+	if len(times) > 0 {
+		merged.Time = times
+	}
+	return merged, nil
+}
+
+// Read manifest of package from disk
+func readManifest(f string) (NpmPackage, error) {
+	npm := NpmPackage{}
+	if _, err := artifact.Restore(f); err != nil {
+		return npm, err
+	}
+	b, err := os.ReadFile(filepath.Clean(f))
+	if err != nil {
+		return npm, err
+	}
+	if err := json.Unmarshal(b, &npm); err != nil {
+		return npm, err
+	}
+	return npm, nil
+}
+
+// Unify serves merged manifest of all members of group. Tarballs in manifest
+// of member point to member, tarball requested from group is served from first
+// member that has it.
+func (n Npm) Unify(name string) error {
+	g, ok := project.Conf.Groups.Npm[name]
+	if !ok {
+		return fmt.Errorf("group: '%s' not found in config file", name)
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return err
+	}
+	members := api.ReadableMembers(n.Request, "npm", g.Members)
+	log.Debugf("group: '%s', members: '%v'", name, members)
+
+	if filepath.Ext(n.Artifact) == ".tgz" {
+		for _, repo := range members {
+			m := n.member(repo)
+			err := m.Preserve()
+			// Package streamed from member to client
+			if artifact.Sent(n.ResponseWriter) {
+				return err
+			}
+			if err != nil {
+				log.Warnf("npm package caching from member: '%s' failed. Error: '%v'", repo, err)
+				continue
+			}
+			if _, fileExists := file.Exists(filepath.Join(h, m.RequestURI)); fileExists {
+				return m.Read()
+			}
+		}
+		return fmt.Errorf("package: '%s' not found in members of group: '%s'", n.Artifact, name)
+	}
+
+	manifests := []NpmPackage{}
+	for _, repo := range members {
+		m := n.member(repo)
+		if err := m.Preserve(); err != nil {
+			log.Warnf("npm manifest caching from member: '%s' failed. Error: '%v'", repo, err)
+			continue
+		}
+		npm, err := readManifest(filepath.Join(h, packagePath(m.RequestURI)+".tmp"))
+		if err != nil {
+			log.Warnf("npm manifest of member: '%s' not read. Error: '%v'", repo, err)
+			continue
+		}
+		manifests = append(manifests, npm)
+	}
+	merged, err := mergeManifests(manifests)
+	if err != nil {
+		return fmt.Errorf("package: '%s' not found in members of group: '%s'. Error: '%w'", n.Artifact, name, err)
+	}
+	return n.sendManifest(merged)
+}
@@ -0,0 +1,461 @@
+package npm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+)
+
+// Upstream npm registry with manifest of one package
+func registry(name, latest string, versions ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+name {
+			http.NotFound(w, r)
+			return
+		}
+		// Publish time differs by registry
+		published := fmt.Sprintf("2023-01-%02dT00:00:00.000Z", len(versions))
+		times := map[string]string{"created": published}
+		npm := NpmPackage{Name: name, DistTags: map[string]string{"latest": latest}, Time: times, Versions: map[string]Package{}}
+		for _, v := range versions {
+			times[v] = published
+			npm.Versions[v] = Package{Name: name, Version: v, Dist: Dist{Tarball: fmt.Sprintf("https://registry.local/%s/-/%s-%s.tgz", name, name, v)}}
+		}
+		json.NewEncoder(w).Encode(npm)
+	}))
+}
+
+func TestUnify(t *testing.T) {
+	private := registry("left-pad", "1.0.0", "1.0.0")
+	defer private.Close()
+	public := registry("left-pad", "1.1.0", "1.0.0", "1.1.0")
+	defer public.Close()
+	project.Conf = project.ConfigFile{
+		Port:     "25213",
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Npm: map[string]project.Repos{
+				"private": {Url: private.URL + "/"},
+				"npmjs":   {Url: public.URL + "/"},
+			},
+		},
+		Groups: project.Groups{
+			Npm: map[string]project.Group{
+				"all": {Members: []string{"private", "npmjs"}},
+			},
+		},
+	}
+	t.Run("merged manifest", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		n := Npm{ResponseWriter: w, RequestURI: "/npm/all/left-pad", Repo: "all", Artifact: "left-pad"}
+		if err := n.Unify("all"); err != nil {
+			t.Fatal(err)
+		}
+		npm := NpmPackage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &npm); err != nil {
+			t.Fatal(err)
+		}
+		if len(npm.Versions) != 2 {
+			t.Fatal("versions not merged ", npm.Versions)
+		}
+		if tags := npm.DistTags.(map[string]interface{}); tags["latest"] != "1.0.0" {
+			t.Fatal("dist-tags latest not from first member ", tags)
+		}
+		times := npm.Time.(map[string]interface{})
+		if times["1.0.0"] != "2023-01-01T00:00:00.000Z" || times["created"] != "2023-01-01T00:00:00.000Z" || times["1.1.0"] != "2023-01-02T00:00:00.000Z" {
+			t.Fatal("time not merged, first member wins ", times)
+		}
+		if tb := npm.Versions["1.1.0"].Dist.Tarball; !strings.HasSuffix(tb, "/npm/npmjs/left-pad/-/left-pad-1.1.0.tgz") {
+			t.Fatal("tarball not point to member ", tb)
+		}
+		if tb := npm.Versions["1.0.0"].Dist.Tarball; !strings.HasSuffix(tb, "/npm/private/left-pad/-/left-pad-1.0.0.tgz") {
+			t.Fatal("tarball not point to member ", tb)
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		n := Npm{ResponseWriter: httptest.NewRecorder(), Repo: "all", Artifact: "right-pad"}
+		if err := n.Unify("all"); err == nil {
+			t.Fatal("package found")
+		}
+	})
+}
+
+// Body of npm publish for package @yaam/util
+func publishBody(version string, tgz []byte) string {
+	shasum, _ := sums(tgz)
+	return fmt.Sprintf(`{"_id":"@yaam/util","name":"@yaam/util","dist-tags":{"latest":"%[1]s"},
+"versions":{"%[1]s":{"name":"@yaam/util","version":"%[1]s","dist":{"shasum":"%[2]s","tarball":"http://localhost/@yaam/util/-/util-%[1]s.tgz"}}},
+"_attachments":{"@yaam/util-%[1]s.tgz":{"content_type":"application/octet-stream","data":"%[3]s","length":%[4]d}}}`,
+		version, shasum, base64.StdEncoding.EncodeToString(tgz), len(tgz))
+}
+
+func TestPublish(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		Port:     "25213",
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Npm: map[string]project.Repos{
+				"internal": {Hosted: true},
+			},
+		},
+	}
+	tgz := []byte("tarball")
+	shasum, integrity := sums(tgz)
+	document := func(version string) string {
+		return publishBody(version, tgz)
+	}
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		t.Run("publish "+version, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			n := Npm{ResponseWriter: w, RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", Artifact: "@yaam/util", RequestBody: io.NopCloser(strings.NewReader(document(version)))}
+			if err := n.Publish(); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusCreated {
+				t.Fatal("wrong status code ", w.Code)
+			}
+		})
+	}
+	t.Run("publish existing version", func(t *testing.T) {
+		n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", RequestBody: io.NopCloser(strings.NewReader(document("1.0.0")))}
+		if err := n.Publish(); !errors.Is(err, NpmVersionExists) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("publish to proxy", func(t *testing.T) {
+		n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/npmjs/@yaam%2futil", Repo: "npmjs", RequestBody: io.NopCloser(strings.NewReader(document("2.0.0")))}
+		if err := n.Publish(); !errors.Is(err, NpmRepoNotHosted) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("read manifest", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		n := Npm{ResponseWriter: w, RequestURI: "/npm/internal/@yaam%2futil?write=true", Repo: "internal", Artifact: "@yaam/util", BaseUrl: "https://yaam.local"}
+		if err := n.Preserve(); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Read(); err != nil {
+			t.Fatal(err)
+		}
+		npm := NpmPackage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &npm); err != nil {
+			t.Fatal(err)
+		}
+		if len(npm.Versions) != 2 || npm.DistTags.(map[string]interface{})["latest"] != "1.1.0" {
+			t.Fatal("versions not merged ", npm)
+		}
+		d := npm.Versions["1.0.0"].Dist
+		if d.ShaSum != shasum || d.Integrity != integrity || d.Tarball != "https://yaam.local/npm/internal/@yaam/util/-/util-1.0.0.tgz" {
+			t.Fatal("wrong dist ", d)
+		}
+	})
+	t.Run("read tarball", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		n := Npm{ResponseWriter: w, RequestURI: "/npm/internal/@yaam/util/-/util-1.1.0.tgz", Repo: "internal"}
+		if err := n.Read(); err != nil {
+			t.Fatal(err)
+		}
+		if w.Body.String() != string(tgz) {
+			t.Fatal("wrong tarball ", w.Body.String())
+		}
+	})
+	t.Run("concurrent publish", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(version string) {
+				defer wg.Done()
+				n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", RequestBody: io.NopCloser(strings.NewReader(document(version)))}
+				errs <- n.Publish()
+			}(fmt.Sprintf("2.0.%d", i))
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, npm, err := hostedManifest("internal", "@yaam/util"); err != nil || len(npm.Versions) != 12 {
+			t.Fatal("versions lost by concurrent publish ", len(npm.Versions), err)
+		}
+		if len(manifestLocks) != 0 {
+			t.Fatal("manifest locks not removed ", manifestLocks)
+		}
+	})
+}
+
+// Backend where other replica publishes version of package just before
+// first replace of manifest
+type racingBackend struct {
+	storage.Local
+	version string
+}
+
+func (b *racingBackend) Replace(key string, r io.Reader, size int64, etag string) error {
+	if b.version != "" && strings.HasSuffix(key, ".tmp") {
+		src, err := b.Get(key)
+		if err != nil {
+			return err
+		}
+		npm := NpmPackage{}
+		if err := json.NewDecoder(src).Decode(&npm); err != nil {
+			return err
+		}
+		src.Close()
+		npm.Versions[b.version] = Package{Name: npm.Name, Version: b.version}
+		other, _ := json.Marshal(npm)
+		if err := b.Put(key, strings.NewReader(string(other)), int64(len(other))); err != nil {
+			return err
+		}
+		b.version = ""
+	}
+	return b.Local.Replace(key, r, size, etag)
+}
+
+func TestPublishConflict(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		Port:     "25213",
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Npm: map[string]project.Repos{
+				"internal": {Hosted: true},
+			},
+		},
+	}
+	backend := &racingBackend{Local: storage.Local{Dir: t.TempDir()}}
+	storage.Backend = backend
+	defer func() { storage.Backend = nil }()
+	publish := func(version string) error {
+		n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", Artifact: "@yaam/util", RequestBody: io.NopCloser(strings.NewReader(publishBody(version, []byte("tarball"))))}
+		return n.Publish()
+	}
+	if err := publish("1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	backend.version = "1.1.0"
+	if err := publish("1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	if backend.version != "" {
+		t.Fatal("manifest not replaced")
+	}
+	_, npm, err := hostedManifest("internal", "@yaam/util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		if _, ok := npm.Versions[v]; !ok {
+			t.Fatalf("version: '%s' lost, versions: '%v'", v, npm.Versions)
+		}
+	}
+}
+
+func TestManage(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		Port:     "25213",
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Npm: map[string]project.Repos{
+				"internal": {Hosted: true},
+				"npmjs":    {Url: "https://registry.npmjs.org/"},
+			},
+		},
+	}
+	for _, version := range []string{"1.0.0", "2.0.0-beta.1", "2.0.0"} {
+		n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", RequestBody: io.NopCloser(strings.NewReader(publishBody(version, []byte(version))))}
+		if err := n.Publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, _ := project.RepositoriesHome()
+	t.Run("dist-tag add", func(t *testing.T) {
+		tags, err := SetDistTag("internal", "@yaam/util", "beta", "2.0.0-beta.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tags["beta"] != "2.0.0-beta.1" || tags["latest"] != "2.0.0" {
+			t.Fatal("wrong dist-tags ", tags)
+		}
+		if _, err := SetDistTag("internal", "@yaam/util", "beta", "3.0.0"); !errors.Is(err, NpmNotFound) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("dist-tag rm", func(t *testing.T) {
+		if _, err := RemoveDistTag("internal", "@yaam/util", "latest"); !errors.Is(err, NpmTagNotValid) {
+			t.Fatal(err)
+		}
+		if _, err := RemoveDistTag("internal", "@yaam/util", "beta"); err != nil {
+			t.Fatal(err)
+		}
+		tags, err := DistTags("internal", "@yaam/util")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tags["beta"]; ok {
+			t.Fatal("dist-tag not removed ", tags)
+		}
+	})
+	t.Run("not hosted", func(t *testing.T) {
+		if _, err := DistTags("npmjs", "@yaam/util"); !errors.Is(err, NpmRepoNotHosted) {
+			t.Fatal(err)
+		}
+	})
+	t.Run("deprecate", func(t *testing.T) {
+		_, npm, err := hostedManifest("internal", "@yaam/util")
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := npm.Versions["1.0.0"]
+		v.Deprecared = "use 2.0.0"
+		npm.Versions["1.0.0"] = v
+		delete(npm.Versions, "2.0.0")
+		b, _ := json.Marshal(npm)
+		n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", RequestBody: io.NopCloser(strings.NewReader(string(b)))}
+		if err := n.Publish(); err != nil {
+			t.Fatal(err)
+		}
+		_, npm, err = hostedManifest("internal", "@yaam/util")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if npm.Versions["1.0.0"].Deprecared != "use 2.0.0" || len(npm.Versions) != 3 {
+			t.Fatal("wrong deprecate ", npm.Versions)
+		}
+	})
+	t.Run("unpublish version", func(t *testing.T) {
+		_, npm, err := hostedManifest("internal", "@yaam/util")
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(npm.Versions, "2.0.0-beta.1")
+		if err := UpdateManifest("internal", "@yaam/util", npm, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(h, "npm/internal/@yaam/util/-/util-2.0.0-beta.1.tgz")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("tarball not removed ", err)
+		}
+		if err := Unpublish("internal", "@yaam/util/-/util-2.0.0-beta.1.tgz"); err != nil {
+			t.Fatal(err)
+		}
+		tags, _ := DistTags("internal", "@yaam/util")
+		if tags["latest"] != "2.0.0" {
+			t.Fatal("wrong dist-tags ", tags)
+		}
+	})
+	t.Run("unpublish package", func(t *testing.T) {
+		if err := Unpublish("internal", "@yaam/util"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(h, "npm/internal/@yaam/util")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("package not removed ", err)
+		}
+		if err := Unpublish("internal", "@yaam/util"); !errors.Is(err, NpmNotFound) {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCleanup(t *testing.T) {
+	project.Conf = project.ConfigFile{
+		Port:     "25213",
+		CacheDir: t.TempDir(),
+		Caches: project.Rep{
+			Npm: map[string]project.Repos{
+				"internal": {Hosted: true, Retention: []project.Retention{{PrereleaseDays: 30}, {KeepLast: 2}}},
+			},
+		},
+	}
+	for _, version := range []string{"1.0.0", "1.1.0", "2.0.0-beta.1", "2.0.0"} {
+		n := Npm{ResponseWriter: httptest.NewRecorder(), RequestURI: "/npm/internal/@yaam%2futil", Repo: "internal", RequestBody: io.NopCloser(strings.NewReader(publishBody(version, []byte(version))))}
+		if err := n.Publish(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mf, npm, err := hostedManifest("internal", "@yaam/util")
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := toMap(npm.Time)
+	times["2.0.0-beta.1"] = time.Now().Add(-60 * 24 * time.Hour).UTC().Format(time.RFC3339Nano)
+	npm.Time = times
+	npm.DistTags = map[string]interface{}{"latest": "1.0.0", "beta": "2.0.0-beta.1"}
+	if err := writeManifest(mf, npm); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := project.RepositoriesHome()
+	versions := func(deleted []artifact.Deleted) string {
+		s := []string{}
+		for _, d := range deleted {
+			s = append(s, d.Version)
+		}
+		return strings.Join(s, ",")
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		deleted, err := Npm{Repo: "internal"}.Cleanup(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions(deleted) != "1.0.0,2.0.0-beta.1" {
+			t.Fatal("wrong versions ", deleted)
+		}
+		if _, npm, _ := hostedManifest("internal", "@yaam/util"); len(npm.Versions) != 4 {
+			t.Fatal("versions removed by dry run")
+		}
+	})
+	t.Run("cleanup", func(t *testing.T) {
+		deleted, err := Npm{Repo: "internal"}.Cleanup(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions(deleted) != "1.0.0,2.0.0-beta.1" {
+			t.Fatal("wrong versions ", deleted)
+		}
+		_, npm, err := hostedManifest("internal", "@yaam/util")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := toMap(npm.DistTags)
+		if len(npm.Versions) != 2 || len(tags) != 1 || tags["latest"] != "2.0.0" {
+			t.Fatal("wrong manifest ", npm.Versions, tags)
+		}
+		if _, err := os.Stat(filepath.Join(h, "npm/internal/@yaam/util/-/util-1.0.0.tgz")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("tarball not removed ", err)
+		}
+	})
+}
+
+func TestRewriteTarballs(t *testing.T) {
+	project.Conf = project.ConfigFile{Port: "25213"}
+	npm := NpmPackage{Versions: map[string]Package{
+		"1.0.0": {Dist: Dist{Tarball: "/npm/npmjs/react/-/react-1.0.0.tgz"}},
+		"2.0.0": {Dist: Dist{Tarball: "http://localhost:25213/npm/npmjs/react/-/react-2.0.0.tgz"}},
+		"3.0.0": {Dist: Dist{Tarball: "https://registry.npmjs.org/react/-/react-3.0.0.tgz"}},
+	}}
+	rewriteTarballs(&npm, "https://yaam.local/")
+	for v, tb := range map[string]string{
+		"1.0.0": "https://yaam.local/npm/npmjs/react/-/react-1.0.0.tgz",
+		"2.0.0": "https://yaam.local/npm/npmjs/react/-/react-2.0.0.tgz",
+		"3.0.0": "https://registry.npmjs.org/react/-/react-3.0.0.tgz",
+	} {
+		if npm.Versions[v].Dist.Tarball != tb {
+			t.Fatalf("wrong tarball: '%s' expected: '%s'", npm.Versions[v].Dist.Tarball, tb)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package npm
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/file"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	NpmPublishNotValid = errors.New("npm publish document is invalid")
+	NpmVersionExists   = errors.New("cannot publish over existing version")
+)
+
+// Tarball in npm publish document
+type attachment struct {
+	ContentType string `json:"content_type,omitempty"`
+	Data        string `json:"data"`
+	Length      int    `json:"length,omitempty"`
+}
+
+// Document sent by npm publish
+type publishDocument struct {
+	NpmPackage
+	Attachments map[string]attachment `json:"_attachments"`
+}
+
+// Request uri with decoded scoped package name and without query
+// /npm/repo/@scope%2fname?write=true -> /npm/repo/@scope/name
+func packagePath(requestURI string) string {
+	p, _, _ := strings.Cut(requestURI, "?")
+	p = strings.Replace(p, "%2f", "/", -1)
+	return strings.Replace(p, "%2F", "/", -1)
+}
+
+// Convert json object from manifest to map
+func toMap(v interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	if src, ok := v.(map[string]interface{}); ok {
+		for k, v := range src {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// Write manifest to disk with new revision
+func writeManifest(f string, npm NpmPackage) error {
+	bumpRev(&npm)
+	b, err := json.Marshal(npm)
+	if err != nil {
+		return err
+	}
+	return file.WriteFile(f, b)
+}
+
+// Calculate shasum and integrity for tarball
+func sums(data []byte) (string, string) {
+	/* #nosec */
+	s1 := sha1.Sum(data)
+	s512 := sha512.Sum512(data)
+	return fmt.Sprintf("%x", s1), "sha512-" + base64.StdEncoding.EncodeToString(s512[:])
+}
+
+// Decode attachment of version from publish document
+func (d publishDocument) tarball(name, version string) ([]byte, error) {
+	a, ok := d.Attachments[fmt.Sprintf("%s-%s.tgz", name, version)]
+	if !ok {
+		a, ok = d.Attachments[fmt.Sprintf("%s-%s.tgz", path.Base(name), version)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: attachment for version: '%s' not found", NpmPublishNotValid, version)
+	}
+	data, err := base64.StdEncoding.DecodeString(a.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", NpmPublishNotValid, err)
+	}
+	if a.Length > 0 && a.Length != len(data) {
+		return nil, fmt.Errorf("%w: attachment length: '%d' does not match data length: '%d'", NpmPublishNotValid, a.Length, len(data))
+	}
+	return data, nil
+}
+
+// Extract tarballs from npm publish document and merge new versions to stored
+// manifest. Return name of published package.
+func publish(requestURI, repo string, body io.Reader) (string, error) {
+	// Proxy caches are filled from upstream only
+	if !project.Conf.IsHosted("npm", repo) {
+		return "", fmt.Errorf("%w: '%s'", NpmRepoNotHosted, repo)
+	}
+	reqPath := packagePath(requestURI)
+	doc := publishDocument{}
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("%w: %v", NpmPublishNotValid, err)
+	}
+	name := strings.TrimPrefix(reqPath, "/npm/"+repo+"/")
+	if doc.Name != name {
+		return "", fmt.Errorf("%w: package name: '%s' does not match url: '%s'", NpmPublishNotValid, doc.Name, reqPath)
+	}
+	// npm deprecate sends manifest without attachments
+	if len(doc.Attachments) == 0 {
+		return name, UpdateManifest(repo, name, doc.NpmPackage, false)
+	}
+	if len(doc.Versions) == 0 {
+		return "", fmt.Errorf("%w: no versions", NpmPublishNotValid)
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return "", err
+	}
+	if err := artifact.DirCreate(reqPath + ".tmp"); err != nil {
+		return "", err
+	}
+	mf := filepath.Join(h, reqPath+".tmp")
+	defer lockManifest(mf)()
+	// Manifest changed by other replica meanwhile is read again
+	if err := storage.RetryOnConflict(func() error { return addVersions(h, repo, reqPath, doc) }); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Store tarballs of publish document and write manifest with new versions,
+// manifest is locked by caller
+func addVersions(h, repo, reqPath string, doc publishDocument) error {
+	name := doc.Name
+	mf := filepath.Join(h, reqPath+".tmp")
+	npm, err := readManifest(mf)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		npm = doc.NpmPackage
+		npm.Id = name
+		npm.Versions = map[string]Package{}
+		npm.DistTags = nil
+		npm.Time = nil
+	}
+	if doc.Description != nil {
+		npm.Description = doc.Description
+	}
+	if doc.ReadMe != nil {
+		npm.ReadMe = doc.ReadMe
+	}
+	tags := toMap(npm.DistTags)
+	times := toMap(npm.Time)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for version, p := range doc.Versions {
+		if _, ok := npm.Versions[version]; ok {
+			return fmt.Errorf("%w: '%s@%s'", NpmVersionExists, name, version)
+		}
+		data, err := doc.tarball(name, version)
+		if err != nil {
+			return err
+		}
+		shasum, integrity := sums(data)
+		if p.Dist.ShaSum != "" && p.Dist.ShaSum != shasum {
+			return fmt.Errorf("%w: shasum of '%s@%s'", CheckSumNotValid, name, version)
+		}
+		if strings.HasPrefix(p.Dist.Integrity, "sha512-") && p.Dist.Integrity != integrity {
+			return fmt.Errorf("%w: integrity of '%s@%s'", CheckSumNotValid, name, version)
+		}
+		pack := fmt.Sprintf("%s-%s.tgz", path.Base(name), version)
+		tgz := reqPath + "/-/" + pack
+		// Tarball left from failed publish without version in manifest
+		if err := storage.Remove(filepath.Join(h, tgz)); err != nil {
+			return err
+		}
+		if err := artifact.StoreOnDisk(tgz, io.NopCloser(bytes.NewReader(data))); err != nil {
+			return err
+		}
+		p.Dist.ShaSum = shasum
+		p.Dist.Integrity = integrity
+		p.Dist.Tarball = tarballUrl(repo, name, pack)
+		npm.Versions[version] = p
+		times[version] = now
+		if len(doc.Versions) == 1 {
+			if _, ok := tags["latest"]; !ok {
+				tags["latest"] = version
+			}
+		}
+		log.Infof("npm package: '%s@%s' published to: '%s'", name, version, repo)
+	}
+	for tag, version := range toMap(doc.DistTags) {
+		tags[tag] = version
+	}
+	if _, ok := times["created"]; !ok {
+		times["created"] = now
+	}
+	times["modified"] = now
+	npm.DistTags = tags
+	npm.Time = times
+	return writeManifest(mf, npm)
+}
@@ -0,0 +1,151 @@
+package npm
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Semver prerelease 1.0.0-beta.1, build metadata is ignored
+func isPrerelease(v string) bool {
+	v, _, _ = strings.Cut(v, "+")
+	return strings.Contains(v, "-")
+}
+
+// Versions of package from oldest to newest publish
+func packageVersions(npm NpmPackage) []artifact.Version {
+	times := toMap(npm.Time)
+	versions := []artifact.Version{}
+	for v := range npm.Versions {
+		published := time.Time{}
+		if s, ok := times[v].(string); ok {
+			published, _ = time.Parse(time.RFC3339Nano, s)
+		}
+		versions = append(versions, artifact.Version{Name: v, Published: published, Prerelease: isPrerelease(v)})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].Published.Equal(versions[j].Published) {
+			return versions[i].Published.Before(versions[j].Published)
+		}
+		return versions[i].Name < versions[j].Name
+	})
+	return versions
+}
+
+// Apply retention rules to versions of package, tarballs of deleted versions
+// are removed and dist-tags point to versions left. Package without versions
+// is removed.
+func cleanupPackage(repo, mf string, npm NpmPackage, rules []project.Retention, dryRun bool, now time.Time) ([]artifact.Deleted, error) {
+	versions := packageVersions(npm)
+	expired, err := artifact.Expired(rules, versions, now)
+	if err != nil {
+		return nil, err
+	}
+	deleted := []artifact.Deleted{}
+	for _, v := range artifact.SortedKeys(expired) {
+		deleted = append(deleted, artifact.Deleted{Repo: repo, Artifact: npm.Name, Version: v, Reason: expired[v]})
+	}
+	if dryRun || len(expired) == 0 {
+		return deleted, nil
+	}
+	if len(expired) == len(versions) {
+		if err := storage.RemoveAll(strings.TrimSuffix(mf, ".tmp")); err != nil {
+			return nil, err
+		}
+		log.Infof("npm package: '%s' deleted from: '%s', no versions left", npm.Name, repo)
+		return deleted, storage.Remove(mf)
+	}
+	times := toMap(npm.Time)
+	for v, reason := range expired {
+		if err := removeTarball(mf, npm, v); err != nil {
+			return nil, err
+		}
+		delete(npm.Versions, v)
+		delete(times, v)
+		log.Infof("npm package: '%s@%s' deleted from: '%s', %s", npm.Name, v, repo, reason)
+	}
+	tags := map[string]interface{}{}
+	for tag, version := range toMap(npm.DistTags) {
+		if v, ok := version.(string); ok && expired[v] == "" {
+			tags[tag] = v
+		}
+	}
+	if _, ok := tags["latest"]; !ok {
+		// Newest release left, newest prerelease if there is no release
+		for _, v := range versions {
+			if expired[v.Name] != "" {
+				continue
+			}
+			if latest, ok := tags["latest"].(string); !ok || !v.Prerelease || isPrerelease(latest) {
+				tags["latest"] = v.Name
+			}
+		}
+	}
+	npm.DistTags = tags
+	times["modified"] = now.UTC().Format(time.RFC3339Nano)
+	npm.Time = times
+	return deleted, writeManifest(mf, npm)
+}
+
+// Apply retention rules to package with manifest locked, unreadable manifest
+// is skipped
+func cleanupManifest(repo, mf string, rules []project.Retention, dryRun bool, now time.Time) ([]artifact.Deleted, error) {
+	defer lockManifest(mf)()
+	npm, err := readManifest(mf)
+	if err != nil {
+		log.Warnf("manifest: '%s' skipped. Error: '%v'", mf, err)
+		return nil, nil
+	}
+	return cleanupPackage(repo, mf, npm, rules, dryRun, now)
+}
+
+// Cleanup apply retention rules of hosted repository to all its packages
+func (n Npm) Cleanup(dryRun bool) ([]artifact.Deleted, error) {
+	repo := project.Conf.GetRepos("npm")[n.Repo]
+	if !repo.Hosted || len(repo.Retention) == 0 {
+		return []artifact.Deleted{}, nil
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return nil, err
+	}
+	repoDir := filepath.Join(h, "npm", n.Repo)
+	if err := storage.SyncDir(repoDir); err != nil {
+		return nil, err
+	}
+	manifests := []string{}
+	err = filepath.WalkDir(repoDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".tmp") {
+			manifests = append(manifests, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	deleted := []artifact.Deleted{}
+	now := time.Now()
+	for _, mf := range manifests {
+		d, err := cleanupManifest(n.Repo, mf, repo.Retention, dryRun, now)
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, d...)
+	}
+	return deleted, nil
+}
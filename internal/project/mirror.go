@@ -0,0 +1,27 @@
+package project
+
+import "gopkg.in/yaml.v3"
+
+// Mirror of upstream repository. Credentials of repository are not sent to
+// mirror, it has own ones.
+//
+//	mirrors:
+//	  - http://deb.debian.org/debian/
+//	  - url: https://mirror.example.com/debian/
+//	    token: {env: MIRROR_TOKEN}
+type Mirror struct {
+	Url     string            `yaml:"url"`
+	User    Secret            `yaml:"user"`
+	Pass    Secret            `yaml:"pass"`
+	Token   Secret            `yaml:"token"`
+	Headers map[string]Secret `yaml:"headers"`
+}
+
+func (m *Mirror) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*m = Mirror{Url: value.Value}
+		return nil
+	}
+	type mirror Mirror
+	return value.Decode((*mirror)(m))
+}
@@ -0,0 +1,46 @@
+package project
+
+import "sync"
+
+// Offline switches set at runtime override config file, key is pack/repo or
+// empty for all repositories
+var (
+	offlineMutex sync.RWMutex
+	offline      = map[string]bool{}
+)
+
+func offlineKey(t, name string) string {
+	if t == "" {
+		return ""
+	}
+	return t + "/" + name
+}
+
+// SetOffline switch repository of type t or all repositories if t is empty
+// offline or online until restart
+func SetOffline(t, name string, on bool) {
+	offlineMutex.Lock()
+	defer offlineMutex.Unlock()
+
+	offline[offlineKey(t, name)] = on
+}
+
+// IsOffline check that repository is served from cache only, it is offline
+// when all repositories or repository itself are switched offline
+func (c *ConfigFile) IsOffline(t, name string) bool {
+	offlineMutex.RLock()
+	defer offlineMutex.RUnlock()
+
+	all, ok := offline[""]
+	if !ok {
+		all = c.Offline
+	}
+	if all {
+		return true
+	}
+	repo, ok := offline[offlineKey(t, name)]
+	if !ok {
+		repo = c.GetRepos(t)[name].Offline
+	}
+	return repo
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,11 +13,50 @@ import (
 var Conf ConfigFile
 
 type ConfigFile struct {
-	Port     string `yaml:"port"`
-	User     string `yaml:"user"`
-	Pass     string `yaml:"pass"`
-	CacheDir string `yaml:"cachedir"`
-	Caches   Rep    `yaml:"caches"`
+	Port     string   `yaml:"port"`
+	User     string   `yaml:"user"`
+	Pass     string   `yaml:"pass"`
+	BaseUrl  string   `yaml:"baseurl"`
+	CacheDir string   `yaml:"cachedir"`
+	Auth     AuthConf `yaml:"auth"`
+	Caches   Rep      `yaml:"caches"`
+	Groups   Groups   `yaml:"groups"`
+	Storage  Storage  `yaml:"storage"`
+	// Size of cache directory, least recently used artifacts of proxy
+	// repositories are evicted when it is exceeded. Zero is unlimited.
+	MaxCacheSize     Size          `yaml:"maxcachesize"`
+	EvictionInterval time.Duration `yaml:"evictioninterval"`
+	// Retention rules of hosted repositories are applied every interval
+	CleanupInterval time.Duration `yaml:"cleanupinterval"`
+	// Artifacts are served from cache only, upstreams are not contacted
+	Offline bool `yaml:"offline"`
+}
+
+// Backend storing cache and hosted artifacts shared by replicas, cache
+// directory is node cache. Default is local cache directory only.
+type Storage struct {
+	Type      string `yaml:"type"`
+	Dir       string `yaml:"dir"`
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey Secret `yaml:"accesskey"`
+	SecretKey Secret `yaml:"secretkey"`
+}
+
+// Sources of users for authentication
+type AuthConf struct {
+	Htpasswd    string              `yaml:"htpasswd"`
+	Tokens      []Token             `yaml:"tokens"`
+	Groups      map[string][]string `yaml:"groups"`
+	RequireRead bool                `yaml:"requireread"`
+	// Users or groups administering yaam, user of config file is admin too
+	Admin []string `yaml:"admin"`
+}
+type Token struct {
+	User  string `yaml:"user"`
+	Token string `yaml:"token"`
 }
 type Rep struct {
 	Apt   map[string]Repos `yaml:"apt"`
@@ -24,13 +64,250 @@ type Rep struct {
 	Maven map[string]Repos `yaml:"maven"`
 }
 type Repos struct {
-	Url  string `yaml:"url"`
-	User string `yaml:"user"`
-	Pass string `yaml:"pass"`
+	Url string `yaml:"url"`
+	// Mirrors tried in order when url times out or responds 5xx, failing
+	// mirror is skipped for a while
+	Mirrors []Mirror `yaml:"mirrors"`
+	// Basic auth of upstream
+	User Secret `yaml:"user"`
+	Pass Secret `yaml:"pass"`
+	// Bearer token of upstream (npm _authToken, GitLab or GitHub package
+	// token) used instead of basic auth
+	Token Secret `yaml:"token"`
+	// Headers sent to upstream, e.g. Private-Token of GitLab
+	Headers map[string]Secret `yaml:"headers"`
+	Hosted  bool              `yaml:"hosted"`
+	// Artifacts are served from cache only, upstream is not contacted
+	Offline bool `yaml:"offline"`
+	// How long metadata (maven-metadata.xml, SNAPSHOT) is served from cache
+	// without revalidation with upstream
+	MetadataMaxAge time.Duration `yaml:"metadatamaxage"`
+	// How long apt release (InRelease, Release, Release.gpg) and indexes not
+	// listed in it are served from cache without revalidation with upstream
+	IndexMaxAge time.Duration `yaml:"indexmaxage"`
+	// How long upstream 404 of artifact is remembered, negative disables it
+	NotFoundTTL time.Duration `yaml:"notfoundttl"`
+	Acl         Acl           `yaml:"acl"`
+	// Indexes generated by hosted apt repository, InRelease is signed with
+	// armored private key
+	Distributions  []string `yaml:"distributions"`
+	Components     []string `yaml:"components"`
+	Architectures  []string `yaml:"architectures"`
+	SigningKey     string   `yaml:"signingkey"`
+	SigningKeyPass string   `yaml:"signingkeypass"`
+	// Size of cached artifacts of proxy repository, zero is unlimited
+	MaxSize Size `yaml:"maxsize"`
+	// Cleanup rules of hosted maven and npm repository
+	Retention []Retention `yaml:"retention"`
+	// HTTP client of upstream
+	Client HttpClient `yaml:"client"`
+}
+
+// HTTP client of upstream repository, zero values are defaults. Upstreams
+// with same configuration share pooled client.
+type HttpClient struct {
+	// Timeout of whole request with body, none by default as artifacts may be
+	// large
+	Timeout time.Duration `yaml:"timeout"`
+	// Timeout of connection and TLS handshake
+	ConnectTimeout time.Duration `yaml:"connecttimeout"`
+	// Timeout of waiting for response headers, none by default
+	ResponseTimeout time.Duration `yaml:"responsetimeout"`
+	// Retries of failed request with backoff, negative disables retries
+	RetryMax     int           `yaml:"retrymax"`
+	RetryWaitMin time.Duration `yaml:"retrywaitmin"`
+	RetryWaitMax time.Duration `yaml:"retrywaitmax"`
+	// Url of HTTP/HTTPS proxy, proxy of environment (HTTPS_PROXY, NO_PROXY)
+	// if empty, direct disables proxy
+	Proxy string `yaml:"proxy"`
+	// PEM bundle of CAs trusted in addition to system ones
+	CACert string `yaml:"cacert"`
+	// PEM certificate and key of client for mutual TLS
+	ClientCert         string `yaml:"clientcert"`
+	ClientKey          string `yaml:"clientkey"`
+	InsecureSkipVerify bool   `yaml:"insecureskipverify"`
+}
+
+// Retention rule applied to each artifact (maven) or package (npm) of hosted
+// repository. Versions not matching pattern are kept, zero disables limit.
+type Retention struct {
+	// Regular expression of versions, all versions if empty
+	Pattern string `yaml:"pattern"`
+	// Newest versions kept
+	KeepLast int `yaml:"keeplast"`
+	// Timestamped builds kept per maven SNAPSHOT version
+	KeepSnapshots int `yaml:"keepsnapshots"`
+	// Prereleases (1.0-rc1, 1.0.0-beta.2, SNAPSHOT) older than days are deleted
+	PrereleaseDays int `yaml:"prereleasedays"`
+}
+
+const (
+	DefaultMetadataMaxAge   = 30 * time.Minute
+	DefaultIndexMaxAge      = 30 * time.Minute
+	DefaultEvictionInterval = 10 * time.Minute
+	DefaultCleanupInterval  = 24 * time.Hour
+	DefaultNotFoundTTL      = 5 * time.Minute
+	DefaultRetryMax         = 5
+	DefaultRetryWaitMin     = 10 * time.Second
+	DefaultRetryWaitMax     = 60 * time.Second
+	DefaultConnectTimeout   = 30 * time.Second
+)
+
+// Retries return retry count of client or default, zero if disabled
+func (c HttpClient) Retries() int {
+	switch {
+	case c.RetryMax < 0:
+		return 0
+	case c.RetryMax == 0:
+		return DefaultRetryMax
+	}
+	return c.RetryMax
+}
+
+// Backoff return minimal and maximal wait before retry or defaults
+func (c HttpClient) Backoff() (time.Duration, time.Duration) {
+	min, max := c.RetryWaitMin, c.RetryWaitMax
+	if min <= 0 {
+		min = DefaultRetryWaitMin
+	}
+	if max <= 0 {
+		max = DefaultRetryWaitMax
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// Connect return connect timeout of client or default
+func (c HttpClient) Connect() time.Duration {
+	if c.ConnectTimeout <= 0 {
+		return DefaultConnectTimeout
+	}
+	return c.ConnectTimeout
+}
+
+// MaxAge return metadata max age of repository or default
+func (r Repos) MaxAge() time.Duration {
+	if r.MetadataMaxAge == 0 {
+		return DefaultMetadataMaxAge
+	}
+	return r.MetadataMaxAge
+}
+
+// IndexAge return apt index max age of repository or default
+func (r Repos) IndexAge() time.Duration {
+	if r.IndexMaxAge == 0 {
+		return DefaultIndexMaxAge
+	}
+	return r.IndexMaxAge
+}
+
+// NegativeTTL return how long upstream 404 is remembered, zero if disabled
+func (r Repos) NegativeTTL() time.Duration {
+	switch {
+	case r.NotFoundTTL < 0:
+		return 0
+	case r.NotFoundTTL == 0:
+		return DefaultNotFoundTTL
+	}
+	return r.NotFoundTTL
 }
 
-func (c *ConfigFile) GetRepos(t string) {
+// Interval return interval of cache eviction or default
+func (c *ConfigFile) Interval() time.Duration {
+	if c.EvictionInterval <= 0 {
+		return DefaultEvictionInterval
+	}
+	return c.EvictionInterval
+}
+
+// CleanupEvery return interval of retention cleanup or default
+func (c *ConfigFile) CleanupEvery() time.Duration {
+	if c.CleanupInterval <= 0 {
+		return DefaultCleanupInterval
+	}
+	return c.CleanupInterval
+}
+
+// Dists return distributions of hosted apt repository or default
+func (r Repos) Dists() []string {
+	if len(r.Distributions) == 0 {
+		return []string{"stable"}
+	}
+	return r.Distributions
+}
+
+// Comps return components of hosted apt repository or default
+func (r Repos) Comps() []string {
+	if len(r.Components) == 0 {
+		return []string{"main"}
+	}
+	return r.Components
+}
+
+// Archs return architectures of hosted apt repository or default
+func (r Repos) Archs() []string {
+	if len(r.Architectures) == 0 {
+		return []string{"amd64"}
+	}
+	return r.Architectures
+}
+
+// Group repositories, members in priority order
+type Groups struct {
+	Npm   map[string]Group `yaml:"npm"`
+	Maven map[string]Group `yaml:"maven"`
+}
+type Group struct {
+	Members []string `yaml:"members"`
+	Acl     Acl      `yaml:"acl"`
+}
+
+// Users or groups allowed to read, publish or administer repository
+type Acl struct {
+	Read    []string `yaml:"read"`
+	Publish []string `yaml:"publish"`
+	Admin   []string `yaml:"admin"`
+}
+
+func (a Acl) Empty() bool {
+	return len(a.Read) == 0 && len(a.Publish) == 0 && len(a.Admin) == 0
+}
+
+// GetRepos return repositories for type package apt, npm or maven
+func (c *ConfigFile) GetRepos(t string) map[string]Repos {
+	switch t {
+	case "apt":
+		return c.Caches.Apt
+	case "npm":
+		return c.Caches.Npm
+	case "maven":
+		return c.Caches.Maven
+	}
+	return nil
+}
+
+// GetGroups return group repositories for type package npm or maven
+func (c *ConfigFile) GetGroups(t string) map[string]Group {
+	switch t {
+	case "npm":
+		return c.Groups.Npm
+	case "maven":
+		return c.Groups.Maven
+	}
+	return nil
+}
+
+// IsHosted check that repository stores published artifacts and has no upstream
+func (c *ConfigFile) IsHosted(t, name string) bool {
+	return c.GetRepos(t)[name].Hosted
+}
 
+// IsGroup check that repository is group repository
+func (c *ConfigFile) IsGroup(t, name string) bool {
+	_, ok := c.GetGroups(t)[name]
+	return ok
 }
 
 const (
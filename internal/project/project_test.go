@@ -2,7 +2,10 @@ package project
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestRepositoriesHome(t *testing.T) {
@@ -26,7 +29,9 @@ func TestReadConfig(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	Conf.ReadConfig("/tmp/yaam2.yml")
+	if err := Conf.ReadConfig("/tmp/yaam2.yml"); err != nil {
+		t.Fatal(err)
+	}
 	if Conf.Caches.Apt["debian"].Url != "http://test.local" {
 		t.Fatal(" Wrong Read Config File Cache Url")
 	}
@@ -38,3 +43,83 @@ func TestReadConfig(t *testing.T) {
 		t.Fatalf("Fatal Remove file %s", err)
 	}
 }
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]Size{"1024": 1024, "500MB": 500 * 1000 * 1000, "200GiB": 200 << 30, "1.5k": 1536, "10 G": 10 << 30}
+	for s, expected := range tests {
+		size, err := ParseSize(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != expected {
+			t.Fatalf("size of: '%s' is: '%d', expected: '%d'", s, size, expected)
+		}
+	}
+	if _, err := ParseSize("ten gigabytes"); err == nil {
+		t.Fatal("invalid size accepted")
+	}
+	if s := Size(200 << 30).String(); s != "200.0GiB" {
+		t.Fatalf("size: '%s' not expected", s)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	t.Setenv("YAAM2_TEST_PASS", "from-env")
+	f := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(f, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := "user: some-user\npass: {env: YAAM2_TEST_PASS}\ntoken: {file: " + f + "}\nheaders:\n  Private-Token: {env: YAAM2_TEST_PASS}\n"
+	r := Repos{}
+	if err := yaml.Unmarshal([]byte(config), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.User != "some-user" || r.Pass != "from-env" || r.Token != "from-file" || r.Headers["Private-Token"] != "from-env" {
+		t.Fatalf("secrets: '%s' '%s' '%s' not expected", string(r.User), string(r.Pass), string(r.Token))
+	}
+	if r.Pass.String() != "**********" {
+		t.Fatal("secret not hidden")
+	}
+	st := Storage{}
+	if err := yaml.Unmarshal([]byte("accesskey: {env: YAAM2_TEST_PASS}\nsecretkey: {file: "+f+"}\n"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.AccessKey != "from-env" || st.SecretKey != "from-file" {
+		t.Fatal("storage keys not read from secrets")
+	}
+	for _, config := range []string{"pass: {env: YAAM2_TEST_MISSING}", "pass: {file: /missing}", "pass: {}"} {
+		if err := yaml.Unmarshal([]byte(config), &Repos{}); err == nil {
+			t.Fatalf("config: '%s' accepted", config)
+		}
+	}
+}
+
+func TestIsOffline(t *testing.T) {
+	c := ConfigFile{Caches: Rep{Apt: map[string]Repos{"debian": {Offline: true}, "ubuntu": {}}}}
+	if !c.IsOffline("apt", "debian") || c.IsOffline("apt", "ubuntu") {
+		t.Fatal("offline of config file not expected")
+	}
+	defer func() { offline = map[string]bool{} }()
+	SetOffline("apt", "debian", false)
+	SetOffline("", "", true)
+	if !c.IsOffline("apt", "debian") || !c.IsOffline("apt", "ubuntu") {
+		t.Fatal("repositories not offline with all repositories offline")
+	}
+	SetOffline("", "", false)
+	if c.IsOffline("apt", "debian") {
+		t.Fatal("switch of repository not applied")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	t.Setenv("YAAM2_TEST_TOKEN", "mirror-token")
+	config := "mirrors:\n  - http://deb.debian.org/debian/\n  - url: https://mirror.example.com/debian/\n    token: {env: YAAM2_TEST_TOKEN}\n"
+	r := Repos{}
+	if err := yaml.Unmarshal([]byte(config), &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Mirrors) != 2 || r.Mirrors[0].Url != "http://deb.debian.org/debian/" || r.Mirrors[0].Token != "" ||
+		r.Mirrors[1].Url != "https://mirror.example.com/debian/" || r.Mirrors[1].Token != "mirror-token" {
+		t.Fatalf("mirrors: '%v' not expected", r.Mirrors)
+	}
+}
@@ -0,0 +1,59 @@
+package project
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret of config file is plain value or read from environment variable or
+// file when config is loaded:
+//
+//	pass: some-pass
+//	pass: {env: NEXUS_PASS}
+//	token: {file: /run/secrets/npm-token}
+type Secret string
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*s = Secret(value.Value)
+		return nil
+	}
+	ref := struct {
+		Env  string `yaml:"env"`
+		File string `yaml:"file"`
+	}{}
+	if err := value.Decode(&ref); err != nil {
+		return err
+	}
+	switch {
+	case ref.Env != "" && ref.File != "":
+		return fmt.Errorf("secret: line '%d' has both env: '%s' and file: '%s'", value.Line, ref.Env, ref.File)
+	case ref.Env != "":
+		v, ok := os.LookupEnv(ref.Env)
+		if !ok {
+			return fmt.Errorf("secret: environment variable: '%s' not set", ref.Env)
+		}
+		*s = Secret(v)
+	case ref.File != "":
+		b, err := os.ReadFile(filepath.Clean(ref.File))
+		if err != nil {
+			return fmt.Errorf("secret: file: '%s' not read. Error: '%v'", ref.File, err)
+		}
+		*s = Secret(strings.TrimSpace(string(b)))
+	default:
+		return fmt.Errorf("secret: line '%d' has neither env nor file", value.Line)
+	}
+	return nil
+}
+
+// String hides value in logs
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "**********"
+}
@@ -0,0 +1,70 @@
+package project
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size in bytes, in config file with unit: 500MB, 200GB, 1TiB
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"TIB", 1 << 40},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseSize parse size with optional unit, K, M, G and T are binary units
+func ParseSize(s string) (Size, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, multiplier = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("size: '%s' is not valid", s)
+	}
+	return Size(n * float64(multiplier)), nil
+}
+
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+func (s Size) String() string {
+	for _, u := range sizeUnits[:4] {
+		if int64(s) >= u.bytes*1024 {
+			continue
+		}
+		if u.bytes == 1<<10 && s < 1<<10 {
+			return fmt.Sprintf("%dB", int64(s))
+		}
+		return fmt.Sprintf("%.1f%s", float64(s)/float64(u.bytes), strings.Replace(u.suffix, "I", "i", 1))
+	}
+	return fmt.Sprintf("%.1fTiB", float64(s)/float64(1<<40))
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Local store objects in directory, e.g. volume shared by replicas
+type Local struct {
+	Dir string
+}
+
+// Conditional replace of objects is atomic within process by mutex and
+// between processes sharing directory by lock file
+var replaceMutex sync.Mutex
+
+// Lock file in directory of storage, it is not an object
+const lockName = ".replace.lock"
+
+// ETag of file from size and modification time
+func localETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+func (l Local) path(key string) (string, error) {
+	f := filepath.Join(l.Dir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(l.Dir, f); err != nil || strings.HasPrefix(rel, "..") {
+		return "", fs.ErrInvalid
+	}
+	return f, nil
+}
+
+// Suffix of temporary files written before rename into place
+const tempSuffix = ".part"
+
+// CreateTemp create hidden temporary file near f: dir/.name.*.part
+func CreateTemp(f string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(f), "."+filepath.Base(f)+".*"+tempSuffix)
+}
+
+// IsTemp report temporary file, e.g. left by interrupted write
+func IsTemp(f string) bool {
+	base := filepath.Base(f)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, tempSuffix)
+}
+
+// FileMode of written files, temporary file is created with 0600
+const FileMode = 0o644
+
+// WriteAtomic write r to temporary file near f, fsync it and rename it to f
+// if all before functions accept temporary file. Directory is synced after
+// rename so that f survives crash. Readers never see partially written f,
+// temporary file is removed on failure. File is written to disk only, it is
+// not uploaded to backend.
+func WriteAtomic(f string, r io.Reader, before ...func(tmp string) error) (int64, error) {
+	tmp, err := CreateTemp(f)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Error(err)
+		}
+	}()
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		return written, closeWith(tmp, err)
+	}
+	if err := tmp.Chmod(FileMode); err != nil {
+		return written, closeWith(tmp, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return written, closeWith(tmp, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return written, err
+	}
+	for _, b := range before {
+		if err := b(tmp.Name()); err != nil {
+			return written, err
+		}
+	}
+	if err := os.Rename(tmp.Name(), f); err != nil {
+		return written, err
+	}
+	return written, syncDir(filepath.Dir(f))
+}
+
+// Sync directory entries, e.g. after rename of file in it. Directories can
+// not be synced on windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		return closeWith(d, err)
+	}
+	return d.Close()
+}
+
+func closeWith(c io.Closer, err error) error {
+	if cerr := c.Close(); cerr != nil {
+		log.Error(cerr)
+	}
+	return err
+}
+
+func (l Local) Put(key string, r io.Reader, size int64) error {
+	f, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), os.ModePerm); err != nil {
+		return err
+	}
+	_, err = WriteAtomic(f, r)
+	return err
+}
+
+func (l Local) Replace(key string, r io.Reader, size int64, etag string) error {
+	replaceMutex.Lock()
+	defer replaceMutex.Unlock()
+	if err := os.MkdirAll(l.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	unlock, err := lockFile(filepath.Join(l.Dir, lockName))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i, err := l.Stat(key)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		if etag != "" {
+			return fmt.Errorf("%w: '%s' deleted", ErrConflict, key)
+		}
+	case err != nil:
+		return err
+	case i.ETag != etag:
+		return fmt.Errorf("%w: '%s'", ErrConflict, key)
+	}
+	return l.Put(key, r, size)
+}
+
+func (l Local) Get(key string) (io.ReadCloser, error) {
+	f, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.Open(filepath.Clean(f))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return src, err
+}
+
+func (l Local) Stat(key string) (Info, error) {
+	f, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(f)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime(), ETag: localETag(fi)}, nil
+}
+
+// List objects with key prefix, temporary files are skipped
+func (l Local) List(prefix string) ([]Info, error) {
+	objects := []Info{}
+	start := l.Dir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = filepath.Join(l.Dir, filepath.FromSlash(prefix[:i]))
+	}
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), tempSuffix) || d.Name() == lockName {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		k := filepath.ToSlash(rel)
+		if !strings.HasPrefix(k, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Info{Key: k, Size: fi.Size(), ModTime: fi.ModTime(), ETag: localETag(fi)})
+		return nil
+	})
+	return objects, err
+}
+
+func (l Local) Delete(key string) error {
+	f, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(f); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lock file f exclusively for processes sharing directory, returned func
+// releases lock
+func lockFile(f string) (func(), error) {
+	l, err := os.OpenFile(filepath.Clean(f), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(l.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, closeWith(l, err)
+	}
+	return func() {
+		if err := syscall.Flock(int(l.Fd()), syscall.LOCK_UN); err != nil {
+			log.Error(err)
+		}
+		if err := l.Close(); err != nil {
+			log.Error(err)
+		}
+	}, nil
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+)
+
+const (
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3 store objects in bucket of S3-compatible storage (AWS, MinIO, Ceph),
+// requests are signed with AWS Signature Version 4 and path-style urls
+type S3 struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// NewS3 create S3 backend, keys not in config file are read from
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+func NewS3(c project.Storage) (S3, error) {
+	s := S3{
+		Endpoint:  strings.TrimSuffix(c.Endpoint, "/"),
+		Bucket:    c.Bucket,
+		Region:    c.Region,
+		Prefix:    c.Prefix,
+		AccessKey: string(c.AccessKey),
+		SecretKey: string(c.SecretKey),
+		Client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s.AccessKey == "" {
+		s.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s.SecretKey == "" {
+		s.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.Endpoint == "" || s.Bucket == "" {
+		return s, errors.New("storage: 's3' requires endpoint and bucket")
+	}
+	return s, nil
+}
+
+// Escape path of object url, slashes are kept
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign request with AWS Signature Version 4, host and all headers of request
+// are signed
+func sign(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+	headers := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		headers["host"] = req.URL.Host
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+	// Query is encoded with %20 for space and sorted by key
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapePath(req.URL.Path),
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], region)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%x", amzDate, scope, sha256.Sum256([]byte(canonicalRequest)))
+	key := hmacSha256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := fmt.Sprintf("%x", hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// Send signed request for object or bucket (key is empty)
+func (s S3) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := s.Endpoint + "/" + s.Bucket + "/"
+	if key != "" {
+		u += escapePath(s.Prefix + key)
+	}
+	if len(query) > 0 {
+		u += "?" + strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// Body is closed by caller, not by transport
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sign(req, s.AccessKey, s.SecretKey, s.Region, time.Now())
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		closeBody(resp)
+		return nil, fmt.Errorf("%w: '%s'", ErrNotFound, key)
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict && len(header) > 0 {
+		closeBody(resp)
+		return nil, fmt.Errorf("%w: '%s'", ErrConflict, key)
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		closeBody(resp)
+		return nil, fmt.Errorf("%s: '%s' failed statusCode: '%d'. Error: '%s'", method, key, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func (s S3) Put(key string, r io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+// Replace use conditional write of S3 with If-Match or If-None-Match
+func (s S3) Replace(key string, r io.Reader, size int64, etag string) error {
+	header := http.Header{"If-None-Match": {"*"}}
+	if etag != "" {
+		header = http.Header{"If-Match": {etag}}
+	}
+	resp, err := s.do(http.MethodPut, key, nil, header, r, size)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
+
+func (s S3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s S3) Stat(key string) (Info, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return Info{}, err
+	}
+	closeBody(resp)
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{Key: key, Size: size, ModTime: modTime, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// Result of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List objects with key prefix, all pages of ListObjectsV2
+func (s S3) List(prefix string) ([]Info, error) {
+	objects := []Info{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		closeBody(resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, Info{Key: strings.TrimPrefix(c.Key, s.Prefix), Size: c.Size, ModTime: c.LastModified, ETag: c.ETag})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s S3) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	closeBody(resp)
+	return nil
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morhayn/yaam2/internal/project"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNotFound = errors.New("object not found in storage")
+	ErrConflict = errors.New("object changed in storage by other replica")
+)
+
+// Object in storage, key is path relative to repositories home with slashes.
+// ETag changes with content of object.
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
+// Storage of cache and hosted artifacts
+type Storage interface {
+	Put(key string, r io.Reader, size int64) error
+	// Replace put object only if its ETag is etag or if it does not exist
+	// when etag is empty, ErrConflict otherwise
+	Replace(key string, r io.Reader, size int64, etag string) error
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (Info, error)
+	List(prefix string) ([]Info, error)
+	Delete(key string) error
+}
+
+// Backend shared by replicas. Nil is default: cache directory is the storage
+// and files are not synced.
+var Backend Storage
+
+// Setup backend from config file
+func Setup(c project.Storage) error {
+	switch c.Type {
+	case "", "local":
+		if c.Dir == "" {
+			Backend = nil
+			return nil
+		}
+		Backend = Local{Dir: c.Dir}
+	case "s3":
+		s, err := NewS3(c)
+		if err != nil {
+			return err
+		}
+		Backend = s
+	default:
+		return fmt.Errorf("storage type: '%s' is not supported", c.Type)
+	}
+	log.Infof("storage: '%s' used", c.Type)
+	return nil
+}
+
+// Key of file in cache, files outside of repositories home have no key
+func key(f string) (string, bool) {
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(h, f)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// ETag of object each cache file of hosted repository was synced with, empty
+// if object did not exist. Mutable files (metadata, manifests, indexes) are
+// downloaded again when object changed and replaced only if object did not
+// change since.
+var (
+	syncedMutex sync.Mutex
+	synced      = map[string]string{}
+)
+
+func setSynced(f, etag string) {
+	syncedMutex.Lock()
+	defer syncedMutex.Unlock()
+
+	synced[f] = etag
+}
+
+func getSynced(f string) (string, bool) {
+	syncedMutex.Lock()
+	defer syncedMutex.Unlock()
+
+	etag, ok := synced[f]
+	return etag, ok
+}
+
+// Upload write file from cache through to backend. File synced before is
+// replaced only if no other replica changed object since, on ErrConflict
+// file in cache is replaced with object.
+func Upload(f string) error {
+	return UploadAs(f, f)
+}
+
+// UploadAs store content of src, e.g. temporary file before it is renamed,
+// as object of cache file f like Upload
+func UploadAs(src, f string) error {
+	k, ok := key(f)
+	if Backend == nil || !ok {
+		return nil
+	}
+	file, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	etag, known := getSynced(f)
+	if known {
+		err = Backend.Replace(k, file, fi.Size(), etag)
+	} else {
+		err = Backend.Put(k, file, fi.Size())
+	}
+	if errors.Is(err, ErrConflict) {
+		if _, rerr := refresh(f, k); rerr != nil {
+			log.Error(rerr)
+		}
+		return fmt.Errorf("file: '%s' not stored in backend: %w", f, err)
+	}
+	if err != nil {
+		return fmt.Errorf("file: '%s' not stored in backend. Error: '%v'", f, err)
+	}
+	// Only files synced with backend before are tracked, artifacts of proxy
+	// repositories do not change
+	if known {
+		info, err := Backend.Stat(k)
+		if err != nil {
+			return err
+		}
+		setSynced(f, info.ETag)
+	}
+	log.Tracef("file: '%s' stored in backend", k)
+	return nil
+}
+
+// Download object to cache file through temporary file near it. Modification
+// time of file is set to that of object, it is time of upload (deploy) and
+// not of download.
+func download(k, f string, modTime time.Time) error {
+	src, err := Backend.Get(k)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Dir(f), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := WriteAtomic(f, src); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(f, time.Now(), modTime)
+}
+
+// Restore download file missing in cache from backend, report that file
+// is in cache
+func Restore(f string) (bool, error) {
+	if _, err := os.Stat(f); err == nil {
+		return true, nil
+	}
+	k, ok := key(f)
+	if Backend == nil || !ok {
+		return false, nil
+	}
+	o, err := Backend.Stat(k)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := download(k, f, o.ModTime); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	log.Debugf("file: '%s' restored from backend", k)
+	return true, nil
+}
+
+// syncFile bring cache file in line with object: download it if it changed, remove
+// file if object synced before was deleted
+func syncFile(f string, o Info, exists bool) error {
+	etag, known := getSynced(f)
+	if o.Key == "" {
+		if exists && known && etag != "" {
+			if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			log.Debugf("file: '%s' removed, deleted from backend", f)
+		}
+		setSynced(f, "")
+		return nil
+	}
+	stale := !exists || known && etag != o.ETag
+	// Cache file of earlier run is stale if object is newer
+	if exists && !known {
+		if fi, err := os.Stat(f); err == nil && (fi.Size() != o.Size || fi.ModTime().Before(o.ModTime)) {
+			stale = true
+		}
+	}
+	if stale {
+		if err := download(o.Key, f, o.ModTime); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return syncFile(f, Info{}, exists)
+			}
+			return err
+		}
+		log.Debugf("file: '%s' refreshed from backend", o.Key)
+	}
+	setSynced(f, o.ETag)
+	return nil
+}
+
+func refresh(f, k string) (bool, error) {
+	_, err := os.Stat(f)
+	exists := err == nil
+	o, err := Backend.Stat(k)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return exists, err
+	}
+	if err := syncFile(f, o, exists); err != nil {
+		return exists, err
+	}
+	_, err = os.Stat(f)
+	return err == nil, nil
+}
+
+// Refresh check file of hosted repository, which other replica may change or
+// delete, with backend before use. Report that file is in cache.
+func Refresh(f string) (bool, error) {
+	k, ok := key(f)
+	if Backend == nil || !ok {
+		_, err := os.Stat(f)
+		return err == nil, nil
+	}
+	return refresh(f, k)
+}
+
+// SyncDir bring files of dir in line with backend: missing and changed files
+// are downloaded, files deleted from backend are removed
+func SyncDir(dir string) error {
+	k, ok := key(dir)
+	if Backend == nil || !ok {
+		return nil
+	}
+	objects, err := Backend.List(k + "/")
+	if err != nil {
+		return err
+	}
+	listed := map[string]bool{}
+	for _, o := range objects {
+		f := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(o.Key, k+"/")))
+		listed[f] = true
+		_, err := os.Stat(f)
+		if err := syncFile(f, o, err == nil); err != nil {
+			return err
+		}
+	}
+	deleted := []string{}
+	syncedMutex.Lock()
+	for f, etag := range synced {
+		if etag != "" && !listed[f] && strings.HasPrefix(f, dir+string(filepath.Separator)) {
+			deleted = append(deleted, f)
+		}
+	}
+	syncedMutex.Unlock()
+	for _, f := range deleted {
+		if err := syncFile(f, Info{}, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Updates of mutable files are run again after conflict with other replica
+const conflictRetries = 3
+
+// RetryOnConflict run update, which reads files from backend and writes them
+// back, again while other replica changes them concurrently
+func RetryOnConflict(update func() error) error {
+	var err error
+	for i := 0; i < conflictRetries; i++ {
+		if err = update(); !errors.Is(err, ErrConflict) {
+			return err
+		}
+		log.Warnf("update retried. Error: '%v'", err)
+	}
+	return err
+}
+
+// Remove delete file from cache and backend
+func Remove(f string) error {
+	if err := os.Remove(f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	k, ok := key(f)
+	if Backend == nil || !ok {
+		return nil
+	}
+	if err := Backend.Delete(k); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	setSynced(f, "")
+	return nil
+}
+
+// RemoveAll delete dir with files from cache and backend
+func RemoveAll(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	k, ok := key(dir)
+	if Backend == nil || !ok {
+		return nil
+	}
+	objects, err := Backend.List(k + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := Backend.Delete(o.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		setSynced(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(o.Key, k+"/"))), "")
+	}
+	return nil
+}
@@ -8,14 +8,18 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/morhayn/yaam2/internal/api"
 	"github.com/morhayn/yaam2/internal/apt"
 	"github.com/morhayn/yaam2/internal/artifact"
+	"github.com/morhayn/yaam2/internal/eviction"
+	"github.com/morhayn/yaam2/internal/file"
 	"github.com/morhayn/yaam2/internal/maven"
 	"github.com/morhayn/yaam2/internal/npm"
 	"github.com/morhayn/yaam2/internal/project"
+	"github.com/morhayn/yaam2/internal/storage"
 
 	"github.com/030/logging/pkg/logging"
 
@@ -33,12 +37,83 @@ func httpNotFoundReadTheLogs(w http.ResponseWriter, err error, req string) {
 	http.Error(w, serverLogMsg, http.StatusNotFound)
 }
 
+// Send 404 with error to client, artifact is not cached and repository is
+// offline
+func httpNotCached(w http.ResponseWriter, err error, req string) {
+	log.Warn(err)
+	fmt.Println(req)
+	http.Error(w, err.Error(), http.StatusNotFound)
+}
+
 func httpInternalServerErrorReadTheLogs(w http.ResponseWriter, err error, req string) {
 	log.Error(err)
 	fmt.Println(req)
 	http.Error(w, serverLogMsg, http.StatusInternalServerError)
 }
 
+func httpBadGateway(w http.ResponseWriter, err error, req string) {
+	log.Error(err)
+	fmt.Println(req)
+	http.Error(w, serverLogMsg, http.StatusBadGateway)
+}
+
+func httpUnauthorized(w http.ResponseWriter, err error, req string) {
+	log.Warn(err)
+	fmt.Println(req)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func httpForbidden(w http.ResponseWriter, err error, req string) {
+	log.Warn(err)
+	fmt.Println(req)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// Send 401, 403 or 500 for error from api validation
+func httpAccessDenied(w http.ResponseWriter, err error, req string) {
+	switch {
+	case errors.Is(err, api.ErrUnauthorized):
+		httpUnauthorized(w, err, req)
+	case errors.Is(err, api.ErrForbidden):
+		httpForbidden(w, err, req)
+	default:
+		httpInternalServerErrorReadTheLogs(w, err, req)
+	}
+}
+
+func httpBadRequest(w http.ResponseWriter, err error, req string) {
+	log.Warn(err)
+	fmt.Println(req)
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func httpConflict(w http.ResponseWriter, err error, req string) {
+	log.Warn(err)
+	fmt.Println(req)
+	http.Error(w, err.Error(), http.StatusConflict)
+}
+
+// Send 405 with error to client, repository does not accept uploads
+func httpMethodNotAllowed(w http.ResponseWriter, err error, req string) {
+	log.Warn(err)
+	fmt.Println(req)
+	http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+}
+
+// Check user access to repository, send error to client if access denied
+func access(w http.ResponseWriter, r *http.Request, pack, repo string, perm api.Permission) bool {
+	user, err := api.Validation(r.Method, r, w)
+	if err != nil {
+		httpAccessDenied(w, err, r.RequestURI)
+		return false
+	}
+	if err := api.Access(user, pack, repo, perm, w); err != nil {
+		httpAccessDenied(w, err, r.RequestURI)
+		return false
+	}
+	return true
+}
+
 func npmBulk(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err := r.Body.Close(); err != nil {
@@ -54,48 +129,370 @@ func npmBulk(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Streaming of artifact to client failed after response was started, client
+// connection is closed so client does not get incomplete artifact as complete
+func streamAborted(err error, req string) {
+	log.Errorf("streaming of: '%s' aborted. Error: '%v'", req, err)
+	panic(http.ErrAbortHandler)
+}
+
 func repoInterface(w http.ResponseWriter, r *http.Request, ar artifact.Artifacter, method string) {
 	defer func() {
 		if err := r.Body.Close(); err != nil {
 			panic(err)
 		}
 	}()
-	if err := api.Validation(r.Method, r, w); err != nil {
-		httpInternalServerErrorReadTheLogs(w, err, r.RequestURI)
+	vars := mux.Vars(r)
+	perm := api.Read
+	if r.Method == method {
+		perm = api.Publish
+	}
+	if !access(w, r, vars["pack"], vars["repo"], perm) {
+		return
+	}
+	if u, ok := ar.(artifact.Unifier); ok && project.Conf.IsGroup(vars["pack"], vars["repo"]) {
+		if r.Method == method {
+			httpInternalServerErrorReadTheLogs(w, fmt.Errorf("publish to group: '%s' is not supported", vars["repo"]), r.RequestURI)
+			return
+		}
+		if err := u.Unify(vars["repo"]); err != nil {
+			if artifact.Sent(w) {
+				streamAborted(err, r.RequestURI)
+			}
+			httpNotFoundReadTheLogs(w, err, r.RequestURI)
+		}
 		return
 	}
 	if r.Method == method {
 		if err := ar.Publish(); err != nil {
-			httpInternalServerErrorReadTheLogs(w, err, r.RequestURI)
+			switch {
+			case errors.Is(err, apt.AptPackageNotValid), errors.Is(err, npm.NpmPublishNotValid), errors.Is(err, npm.CheckSumNotValid):
+				httpBadRequest(w, err, r.RequestURI)
+			case errors.Is(err, apt.AptPackageExists), errors.Is(err, npm.NpmVersionExists), errors.Is(err, storage.ErrConflict):
+				httpConflict(w, err, r.RequestURI)
+			case errors.Is(err, npm.NpmRepoNotHosted):
+				httpMethodNotAllowed(w, err, r.RequestURI)
+			default:
+				httpInternalServerErrorReadTheLogs(w, err, r.RequestURI)
+			}
 			return
 		}
 		return
 	}
 
 	if err := ar.Preserve(); err != nil {
+		if artifact.Sent(w) {
+			streamAborted(err, r.RequestURI)
+		}
+		if errors.Is(err, file.CheckSumNotValid) {
+			httpBadGateway(w, fmt.Errorf("artifact from upstream rejected. Error: '%v'", err), r.RequestURI)
+			return
+		}
+		if errors.Is(err, artifact.OfflineNotCached) {
+			httpNotCached(w, err, r.RequestURI)
+			return
+		}
 		httpNotFoundReadTheLogs(w, fmt.Errorf("maven artifact caching failed. Error: '%v'", err), r.RequestURI)
 		return
 	}
+	// Artifact streamed to client while it was cached
+	if artifact.Sent(w) {
+		return
+	}
 
 	if err := ar.Read(); err != nil {
 		httpNotFoundReadTheLogs(w, fmt.Errorf("cannot read artifact from disk. Error: '%v'. Perhaps it resides in another repository?", err), r.RequestURI)
 		return
 	}
 }
-func repository(w http.ResponseWriter, r *http.Request) {
+
+// Send 404 or 400 for error from npm package management
+func npmError(w http.ResponseWriter, err error, req string) {
+	switch {
+	case errors.Is(err, npm.NpmNotFound), errors.Is(err, npm.NpmRepoNotHosted):
+		httpNotFoundReadTheLogs(w, err, req)
+	case errors.Is(err, npm.NpmTagNotValid), errors.Is(err, npm.NpmPathNotValid), errors.Is(err, npm.NpmPublishNotValid):
+		httpBadRequest(w, err, req)
+	default:
+		httpInternalServerErrorReadTheLogs(w, err, req)
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}, req string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("response for: '%s' not sent. Error: '%v'", req, err)
+	}
+}
+
+// npm dist-tag ls, add and rm
+func npmDistTags(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	vars := mux.Vars(r)
+	perm := api.Publish
+	if r.Method == "GET" {
+		perm = api.Read
+	}
+	if !access(w, r, "npm", vars["repo"], perm) {
+		return
+	}
+	var (
+		tags map[string]interface{}
+		err  error
+	)
+	switch r.Method {
+	case "PUT":
+		var version string
+		if err := json.NewDecoder(r.Body).Decode(&version); err != nil {
+			httpBadRequest(w, fmt.Errorf("%w: %v", npm.NpmTagNotValid, err), r.RequestURI)
+			return
+		}
+		tags, err = npm.SetDistTag(vars["repo"], vars["pkg"], vars["tag"], version)
+	case "DELETE":
+		tags, err = npm.RemoveDistTag(vars["repo"], vars["pkg"], vars["tag"])
+	default:
+		tags, err = npm.DistTags(vars["repo"], vars["pkg"])
+	}
+	if err != nil {
+		npmError(w, err, r.RequestURI)
+		return
+	}
+	writeJson(w, tags, r.RequestURI)
+}
+
+// npm unpublish of version (PUT manifest) or package and tarball (DELETE)
+func npmUnpublish(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	vars := mux.Vars(r)
+	if !access(w, r, "npm", vars["repo"], api.Admin) {
+		return
+	}
+	if r.Method == "PUT" {
+		doc := npm.NpmPackage{}
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			httpBadRequest(w, fmt.Errorf("%w: %v", npm.NpmPublishNotValid, err), r.RequestURI)
+			return
+		}
+		if err := npm.UpdateManifest(vars["repo"], vars["pkg"], doc, true); err != nil {
+			npmError(w, err, r.RequestURI)
+			return
+		}
+	} else if err := npm.Unpublish(vars["repo"], vars["pkg"]); err != nil {
+		npmError(w, err, r.RequestURI)
+		return
+	}
+	writeJson(w, map[string]bool{"ok": true}, r.RequestURI)
+}
+
+// Check that user administers yaam, send error to client if access denied
+func adminAccess(w http.ResponseWriter, r *http.Request) bool {
+	user, err := api.Validation(r.Method, r, w)
+	if err != nil {
+		httpAccessDenied(w, err, r.RequestURI)
+		return false
+	}
+	if err := api.AccessAdmin(user, w); err != nil {
+		httpAccessDenied(w, err, r.RequestURI)
+		return false
+	}
+	return true
+}
+
+// Result of last cache eviction (GET) or of eviction run now (POST)
+func evict(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if !adminAccess(w, r) {
+		return
+	}
+	result := eviction.Last()
+	if r.Method == "POST" {
+		var err error
+		if result, err = eviction.Run(); err != nil {
+			httpInternalServerErrorReadTheLogs(w, err, r.RequestURI)
+			return
+		}
+	}
+	writeJson(w, result, r.RequestURI)
+}
+
+// Remembered upstream 404 (GET) or flush of them (DELETE): all for admin of
+// yaam, of repository or artifact path for admin of repository
+func notFound(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	vars := mux.Vars(r)
+	if vars["pack"] == "" {
+		if !adminAccess(w, r) {
+			return
+		}
+	} else if !access(w, r, vars["pack"], vars["repo"], api.Admin) {
+		return
+	}
+	h, err := project.RepositoriesHome()
+	if err != nil {
+		httpInternalServerErrorReadTheLogs(w, err, r.RequestURI)
+		return
+	}
+	if strings.Contains(vars["artifact"], "..") {
+		httpBadRequest(w, fmt.Errorf("artifact path: '%s' is not valid", vars["artifact"]), r.RequestURI)
+		return
+	}
+	dir := filepath.Join(h, vars["pack"], vars["repo"], filepath.FromSlash(vars["artifact"]))
+	if r.Method == "DELETE" {
+		writeJson(w, map[string]int{"flushed": artifact.FlushNotFound(dir)}, r.RequestURI)
+		return
+	}
+	entries := map[string]time.Time{}
+	for f, expires := range artifact.NotFoundEntries() {
+		if rel, err := filepath.Rel(dir, f); err == nil && !strings.HasPrefix(rel, "..") {
+			k, _ := filepath.Rel(h, f)
+			entries[filepath.ToSlash(k)] = expires
+		}
+	}
+	writeJson(w, entries, r.RequestURI)
+}
+
+// Offline state (GET), switch offline (PUT) or online (DELETE) until restart:
+// all repositories for admin of yaam, repository for admin of repository
+func offline(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	vars := mux.Vars(r)
+	if vars["pack"] == "" {
+		if !adminAccess(w, r) {
+			return
+		}
+	} else if !access(w, r, vars["pack"], vars["repo"], api.Admin) {
+		return
+	}
+	if vars["pack"] != "" {
+		if _, ok := project.Conf.GetRepos(vars["pack"])[vars["repo"]]; !ok {
+			httpNotFoundReadTheLogs(w, fmt.Errorf("repository: '%s/%s' not found in config file", vars["pack"], vars["repo"]), r.RequestURI)
+			return
+		}
+	}
+	name := "all repositories"
+	if vars["pack"] != "" {
+		name = fmt.Sprintf("repository: '%s/%s'", vars["pack"], vars["repo"])
+	}
+	switch r.Method {
+	case "PUT":
+		project.SetOffline(vars["pack"], vars["repo"], true)
+		log.Infof("%s switched offline", name)
+	case "DELETE":
+		project.SetOffline(vars["pack"], vars["repo"], false)
+		log.Infof("%s switched online", name)
+	}
+	if vars["pack"] != "" {
+		writeJson(w, map[string]bool{"offline": project.Conf.IsOffline(vars["pack"], vars["repo"])}, r.RequestURI)
+		return
+	}
+	repos := map[string]bool{}
+	for _, pack := range []string{"apt", "maven", "npm"} {
+		for repo, c := range project.Conf.GetRepos(pack) {
+			if !c.Hosted {
+				repos[pack+"/"+repo] = project.Conf.IsOffline(pack, repo)
+			}
+		}
+	}
+	writeJson(w, map[string]interface{}{"offline": project.Conf.IsOffline("", ""), "repositories": repos}, r.RequestURI)
+}
+
+// Cleaner of hosted repository
+func cleaner(pack, repo string) (artifact.Cleaner, bool) {
+	if !project.Conf.IsHosted(pack, repo) {
+		return nil, false
+	}
+	switch pack {
+	case "maven":
+		return maven.Maven{Repo: repo}, true
+	case "npm":
+		return npm.Npm{Repo: repo}, true
+	}
+	return nil, false
+}
+
+// Versions deleted by retention rules of hosted repository, GET is dry run
+func cleanup(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	vars := mux.Vars(r)
+	if !access(w, r, vars["pack"], vars["repo"], api.Admin) {
+		return
+	}
+	c, ok := cleaner(vars["pack"], vars["repo"])
+	if !ok {
+		httpNotFoundReadTheLogs(w, fmt.Errorf("repository: '%s/%s' is not hosted maven or npm repository", vars["pack"], vars["repo"]), r.RequestURI)
+		return
+	}
+	dryRun := r.Method == "GET" || r.URL.Query().Get("dryrun") == "true"
+	deleted, err := c.Cleanup(dryRun)
+	if err != nil {
+		httpInternalServerErrorReadTheLogs(w, err, r.RequestURI)
+		return
+	}
+	writeJson(w, map[string]interface{}{"dryrun": dryRun, "deleted": deleted}, r.RequestURI)
+}
+
+// Apply retention rules of hosted repositories every cleanup interval
+func cleanupHosted() {
+	for {
+		time.Sleep(project.Conf.CleanupEvery())
+		for _, pack := range []string{"maven", "npm"} {
+			for repo := range project.Conf.GetRepos(pack) {
+				c, ok := cleaner(pack, repo)
+				if !ok {
+					continue
+				}
+				deleted, err := c.Cleanup(false)
+				if err != nil {
+					log.Errorf("cleanup of: '%s/%s' failed. Error: '%v'", pack, repo, err)
+					continue
+				}
+				if len(deleted) > 0 {
+					log.Infof("cleanup of: '%s/%s' deleted: '%d' versions", pack, repo, len(deleted))
+				}
+			}
+		}
+	}
+}
+
+func repository(rw http.ResponseWriter, r *http.Request) {
 	var ar artifact.Artifacter
+	w := &artifact.Response{ResponseWriter: rw}
 	method := "PUT"
 	vars := mux.Vars(r)
 	switch vars["pack"] {
 	case "npm":
-		ar = npm.Npm{RequestBody: r.Body, RequestURI: r.RequestURI, ResponseWriter: w, Repo: vars["repo"], Artifact: vars["artifact"]}
-		method = "POST"
+		ar = npm.Npm{Request: r, RequestBody: r.Body, RequestURI: r.RequestURI, ResponseWriter: w, Repo: vars["repo"], Artifact: vars["artifact"], BaseUrl: api.BaseUrl(r)}
 	case "apt":
-		ar = apt.Apt{RequestBody: r.Body, RequestURI: r.RequestURI, ResponseWriter: w, Repo: vars["repo"], Artifact: vars["artifact"]}
+		ar = apt.Apt{Request: r, RequestBody: r.Body, RequestURI: r.RequestURI, ResponseWriter: w, Repo: vars["repo"], Artifact: vars["artifact"]}
 	case "maven":
-		ar = maven.Maven{RequestBody: r.Body, RequestURI: r.RequestURI, ResponseWriter: w, Repo: vars["repo"], Artifact: vars["artifact"]}
+		ar = maven.Maven{Request: r, RequestBody: r.Body, RequestURI: r.RequestURI, ResponseWriter: w, Repo: vars["repo"], Artifact: vars["artifact"]}
 	default:
 		httpNotFoundReadTheLogs(w, errors.New("not found repository"), r.RequestURI)
+		return
 	}
 	repoInterface(w, r, ar, method)
 }
@@ -113,7 +510,10 @@ func status(w http.ResponseWriter, r *http.Request) {
 }
 
 func Webapi(conf string) {
-	project.Conf.ReadConfig(conf)
+	// Missing secret aborts decoding, half read config is not used
+	if err := project.Conf.ReadConfig(conf); err != nil {
+		log.Fatalf("config file: '%s' not read. Error: '%v'", conf, err)
+	}
 	logLevel := "info"
 	logLevelEnv := os.Getenv("YAAM_LOG_LEVEL")
 	if logLevelEnv != "" {
@@ -130,14 +530,40 @@ func Webapi(conf string) {
 		log.Fatal(err)
 	}
 
+	if err := api.LoadUsers(project.Conf); err != nil {
+		log.Fatal(err)
+	}
+	// Writes interrupted by crash leave temporary files in cache
+	rh, err := project.RepositoriesHome()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := file.RemoveTemp(rh); err != nil {
+		log.Fatal(err)
+	}
+	if err := storage.Setup(project.Conf.Storage); err != nil {
+		log.Fatal(err)
+	}
+	eviction.Start()
+	go cleanupHosted()
+
 	r := mux.NewRouter()
+	r.HandleFunc("/admin/eviction", evict).Methods("GET", "POST")
+	r.HandleFunc("/admin/cleanup/{pack}/{repo}", cleanup).Methods("GET", "POST")
+	r.HandleFunc("/admin/notfound", notFound).Methods("GET", "DELETE")
+	r.HandleFunc("/admin/offline", offline).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/admin/offline/{pack}/{repo}", offline).Methods("GET", "PUT", "DELETE")
+	r.HandleFunc("/admin/notfound/{pack}/{repo}", notFound).Methods("GET", "DELETE")
+	r.HandleFunc("/admin/notfound/{pack}/{repo}/{artifact:.*}", notFound).Methods("GET", "DELETE")
 	r.HandleFunc("/npm/{repo}/-/npm/v1/security/advisories/bulk", npmBulk)
 	r.HandleFunc("/npm/{repo}/-/npm/v1/security/audits/quick", npmBulk)
-	r.HandleFunc("/{pack}/{repo}/{artifact:.*}", repository)
+	r.HandleFunc("/npm/{repo}/-/package/{pkg:.+}/dist-tags/{tag}", npmDistTags).Methods("PUT", "DELETE")
+	r.HandleFunc("/npm/{repo}/-/package/{pkg:.+}/dist-tags", npmDistTags).Methods("GET")
+	r.HandleFunc("/npm/{repo}/{pkg:.+}/-rev/{rev}", npmUnpublish).Methods("PUT", "DELETE")
+	r.HandleFunc("/{pack}/{repo}/{artifact:.*}", repository).Methods("GET", "HEAD", "PUT", "POST")
 	// r.HandleFunc("/{pack}/{repo}/{artifact:.*}", Artifact)
 	// r.HandleFunc("/{pack}/{repo}/{artifact:.*}", Artifact)
 	// r.HandleFunc("/generic/{repo}/{artifact:.*}", genericArtifact)
-	// r.HandleFunc("/maven/groups/{name}/{artifact:.*}", mavenGroup)
 	r.HandleFunc("/status", status)
 
 	srv := &http.Server{
@@ -149,7 +575,7 @@ func Webapi(conf string) {
 		Handler:      r, // Pass our instance of gorilla/mux in.
 	}
 
-	log.Infof("Starting YAAM version: '%s' on localhost on port: '%d'...", Version, project.Conf.Port)
+	log.Infof("Starting YAAM version: '%s' on localhost on port: '%s'...", Version, project.Conf.Port)
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}